@@ -9,4 +9,5 @@ require github.com/kr/fs v0.1.0 // indirect
 require (
 	github.com/pkg/sftp v1.13.7
 	golang.org/x/sys v0.28.0 // indirect
+	golang.org/x/text v0.21.0
 )
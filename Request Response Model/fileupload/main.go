@@ -1,15 +1,80 @@
 package main
 
 import (
+	"encoding/base64"
 	"fileupload/upload"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 func main() {
 	setupDirectories()
+	setupStorage()
+
+	// Drop files a crash left half written before anything else touches them
+	removed, err := upload.RemovePartialUploads()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if removed > 0 {
+		fmt.Printf("Removed %d partially written upload(s)\n", removed)
+	}
+
+	setupLimits()
+	setupPolicies()
+	setupSSH()
+
+	// SSH destination profiles, so clients need not send credentials
+	profiles, err := upload.LoadDestinations()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if profiles > 0 {
+		fmt.Printf("Loaded %d SSH destination(s)\n", profiles)
+	}
+
+	// How long sessions live, before restored ones get their expiry
+	if ttl := os.Getenv("UPLOAD_SESSION_TTL"); ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			log.Fatalf("invalid UPLOAD_SESSION_TTL: %v", err)
+		}
+		if d <= 0 {
+			log.Fatalf("invalid UPLOAD_SESSION_TTL: must be positive, got %s", ttl)
+		}
+		upload.SessionTTL = d
+	}
+
+	// What each client already stored counts against its quota
+	owned, err := upload.LoadStoredUsage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if owned > 0 {
+		fmt.Printf("Counted %d stored file(s) against client quotas\n", owned)
+	}
+
+	// Resume chunked uploads that were in progress before a restart.
+	// Resumed merges and relays need the settings and destinations above
+	restored, err := upload.LoadSessions()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if restored > 0 {
+		fmt.Printf("Restored %d chunked upload session(s)\n", restored)
+	}
+
+	// Expire abandoned upload sessions and their chunks
+	reapInterval := time.Minute
+	if upload.SessionTTL < reapInterval {
+		reapInterval = upload.SessionTTL
+	}
+	upload.StartReaper(reapInterval)
 
 	// Serve static files
 	http.Handle("/", http.FileServer(http.Dir("static")))
@@ -21,16 +86,28 @@ func main() {
 	http.HandleFunc("/api/v1/upload/init", upload.HandleInitiateUpload)
 	http.HandleFunc("/api/v1/upload/chunk", upload.HandleChunkedUpload)
 	http.HandleFunc("/api/v1/upload/status", upload.HandleUploadStatus)
+	http.HandleFunc("/api/v1/upload/session", upload.HandleCancelUpload)
+	http.HandleFunc("/api/v1/upload/events", upload.HandleUploadEvents)
+
+	// Stored files
+	http.HandleFunc("/api/v1/files", upload.HandleListFiles)
+	http.HandleFunc("/api/v1/files/metadata", upload.HandleFileMetadata)
+	http.HandleFunc("/api/v1/files/download", upload.HandleDownload)
+
+	// tus 1.0 resumable upload protocol
+	http.HandleFunc(upload.TusBasePath, upload.HandleTus)
 
 	// Add SSH upload endpoint
 	http.HandleFunc("/api/v1/ssh/upload", upload.HandleSSHUpload)
 	http.HandleFunc("/api/v1/ssh/test", upload.HandleSSHTest)
+	http.HandleFunc("/api/v1/ssh/destinations", upload.HandleDestinations)
 
 	fmt.Println("Server starting on http://localhost:8080")
 	fmt.Println("- Single file upload: POST /api/v1/upload")
 	fmt.Println("- Chunked upload: POST /api/v1/upload/init")
+	fmt.Println("- tus upload: POST " + upload.TusBasePath)
 
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := http.ListenAndServe(":8080", upload.WithRequestID(http.DefaultServeMux)); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -40,6 +117,7 @@ func setupDirectories() {
 		"uploads",
 		"uploads/temp",
 		"uploads/final",
+		"uploads/staging",
 		"static",
 	}
 
@@ -49,3 +127,173 @@ func setupDirectories() {
 		}
 	}
 }
+
+// setupStorage picks where finished uploads land. Local disk is the default;
+// set UPLOAD_STORAGE=s3 and the S3_* variables to use an S3-compatible bucket.
+func setupStorage() {
+	switch backend := os.Getenv("UPLOAD_STORAGE"); backend {
+	case "", "local":
+		fmt.Println("Storing finished uploads in uploads/final")
+	case "s3":
+		pathStyle, _ := strconv.ParseBool(os.Getenv("S3_PATH_STYLE"))
+		storage, err := upload.NewS3Storage(upload.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    os.Getenv("S3_BUCKET"),
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			Prefix:    os.Getenv("S3_PREFIX"),
+			PathStyle: pathStyle,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		upload.FinalStorage = storage
+		fmt.Printf("Storing finished uploads in s3 bucket %s\n", os.Getenv("S3_BUCKET"))
+	default:
+		log.Fatalf("unknown UPLOAD_STORAGE %q (want local or s3)", backend)
+	}
+
+	// Store files under server assigned keys instead of client filenames
+	upload.UseStorageKeys, _ = strconv.ParseBool(os.Getenv("UPLOAD_STORAGE_KEYS"))
+}
+
+// setupLimits applies size and concurrency limits from the environment. Sizes
+// are in bytes; 0 disables a limit.
+func setupLimits() {
+	limits := map[string]*int64{
+		"UPLOAD_MAX_FILE_SIZE":  &upload.MaxFileSize,
+		"UPLOAD_MIN_CHUNK_SIZE": &upload.MinChunkSize,
+		"UPLOAD_MAX_CHUNK_SIZE": &upload.MaxChunkSize,
+		"UPLOAD_CLIENT_QUOTA":   &upload.ClientQuota,
+	}
+
+	for name, limit := range limits {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid %s %q: want a number of bytes", name, value)
+		}
+		*limit = n
+	}
+
+	concurrency := map[string]*int{
+		"UPLOAD_MAX_SESSION_CHUNKS": &upload.MaxSessionChunks,
+		"UPLOAD_MAX_CHUNK_WRITES":   &upload.MaxChunkWrites,
+	}
+
+	for name, limit := range concurrency {
+		value := os.Getenv(name)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid %s %q: want a number of requests", name, value)
+		}
+		*limit = n
+	}
+}
+
+// setupSSH configures how SSH host keys are verified. SSH_KNOWN_HOSTS points
+// at the known_hosts file; SSH_HOST_KEY_MODE=tofu records unknown hosts on
+// first use instead of refusing them. SSH_DESTINATIONS_KEY encrypts the
+// secrets of destination profiles. SSH_UPLOAD_RETRIES, SSH_RETRY_DELAY,
+// SSH_RETRY_MAX_DELAY and SSH_RESUME_HASH control retrying and resuming
+// failed relays, SSH_MAX_RELAYS how many chunked uploads are forwarded at
+// once.
+func setupSSH() {
+	if file := os.Getenv("SSH_KNOWN_HOSTS"); file != "" {
+		upload.KnownHostsFile = file
+	}
+
+	switch mode := upload.HostKeyMode(os.Getenv("SSH_HOST_KEY_MODE")); mode {
+	case "":
+	case upload.HostKeyStrict, upload.HostKeyTOFU:
+		upload.SSHHostKeyMode = mode
+	default:
+		log.Fatalf("unknown SSH_HOST_KEY_MODE %q (want strict or tofu)", mode)
+	}
+	// Key for secrets in SSH destination profiles, base64 encoded 32 bytes
+	if key := os.Getenv("SSH_DESTINATIONS_KEY"); key != "" {
+		decoded, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(decoded) != 32 {
+			log.Fatal("invalid SSH_DESTINATIONS_KEY: want 32 bytes, base64 encoded")
+		}
+		upload.DestinationsKey = decoded
+	}
+
+	// Retrying a relay means staging uploads on disk instead of streaming them
+	if retries := os.Getenv("SSH_UPLOAD_RETRIES"); retries != "" {
+		n, err := strconv.Atoi(retries)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid SSH_UPLOAD_RETRIES %q: want a number of retries", retries)
+		}
+		upload.SSHRetries = n
+	}
+	delays := map[string]*time.Duration{
+		"SSH_RETRY_DELAY":     &upload.SSHRetryDelay,
+		"SSH_RETRY_MAX_DELAY": &upload.SSHMaxRetryDelay,
+	}
+	for name, delay := range delays {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatalf("invalid %s: %v", name, err)
+			}
+			*delay = d
+		}
+	}
+	if relays := os.Getenv("SSH_MAX_RELAYS"); relays != "" {
+		n, err := strconv.Atoi(relays)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid SSH_MAX_RELAYS %q: want a number of transfers", relays)
+		}
+		upload.MaxRelays = n
+	}
+	if hash := os.Getenv("SSH_RESUME_HASH"); hash != "" {
+		verify, err := strconv.ParseBool(hash)
+		if err != nil {
+			log.Fatalf("invalid SSH_RESUME_HASH %q", hash)
+		}
+		upload.SSHResumeHash = verify
+	}
+
+	fmt.Printf("Verifying SSH host keys against %s (%s)\n", upload.KnownHostsFile, upload.SSHHostKeyMode)
+}
+
+// setupPolicies reads per endpoint content policies from the environment,
+// e.g. UPLOAD_POLICY_SINGLE_ALLOW=image/,application/pdf. Lists are comma
+// separated MIME types or prefixes ending in a slash.
+func setupPolicies() {
+	for endpoint, policy := range upload.Policies {
+		prefix := "UPLOAD_POLICY_" + strings.ToUpper(endpoint) + "_"
+
+		if allow, ok := os.LookupEnv(prefix + "ALLOW"); ok {
+			policy.Allow = splitList(allow)
+		}
+		if deny, ok := os.LookupEnv(prefix + "DENY"); ok {
+			policy.Deny = splitList(deny)
+		}
+		if match := os.Getenv(prefix + "REQUIRE_MATCH"); match != "" {
+			requireMatch, err := strconv.ParseBool(match)
+			if err != nil {
+				log.Fatalf("invalid %sREQUIRE_MATCH %q", prefix, match)
+			}
+			policy.RequireMatch = requireMatch
+		}
+	}
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
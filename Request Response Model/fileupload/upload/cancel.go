@@ -0,0 +1,140 @@
+package upload
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// ErrUploadCancelled is returned by work that was cut short because the
+// client cancelled the upload.
+var ErrUploadCancelled = errors.New("upload cancelled")
+
+// HandleCancelUpload aborts an upload session. Chunks sent to it afterwards
+// get 410 Gone, a running merge is stopped and uploads/temp/<id> is deleted.
+// Deleting a completed session only forgets it; the stored file stays.
+func HandleCancelUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		methodNotAllowed(w, http.MethodDelete)
+		return
+	}
+
+	uploadID := r.URL.Query().Get("uploadId")
+
+	uploadsMutex.RLock()
+	upload, exists := activeUploads[uploadID]
+	uploadsMutex.RUnlock()
+
+	if !exists {
+		writeError(w, http.StatusNotFound, CodeUploadNotFound, "Upload session not found")
+		return
+	}
+
+	state, err := cancelUpload(upload)
+	if err != nil {
+		writeError(w, http.StatusGone, CodeUploadCancelled, "Upload session already cancelled")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"uploadId": upload.ID,
+		"status":   state,
+	})
+}
+
+// cancelUpload stops the session and deletes its data. The session stays in
+// activeUploads as cancelled until the reaper drops it, so late requests can
+// be told it is gone. It returns the state the session ended up in.
+func cancelUpload(upload *ChunkedUpload) (UploadState, error) {
+	upload.mutex.Lock()
+	switch upload.State {
+	case StateCancelled:
+		upload.mutex.Unlock()
+		return "", ErrUploadCancelled
+	case StateCompleted:
+		upload.mutex.Unlock()
+		discardUpload(upload)
+		return StateCompleted, nil
+	}
+
+	upload.State = StateCancelled
+	upload.Error = ""
+	upload.touch()
+	if upload.cancelFinish != nil {
+		upload.cancelFinish(ErrUploadCancelled)
+	}
+	upload.publishState()
+	upload.mutex.Unlock()
+
+	os.RemoveAll(tempDir(upload.ID))
+	fmt.Printf("Upload %s cancelled\n", upload.ID)
+	return StateCancelled, nil
+}
+
+// beginFinish returns the context that finishing the upload runs under. It is
+// cancelled with ErrUploadCancelled when the client cancels the upload; ok is
+// false if that already happened.
+func (upload *ChunkedUpload) beginFinish() (ctx context.Context, ok bool) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	if upload.State == StateCancelled {
+		return nil, false
+	}
+	ctx, upload.cancelFinish = context.WithCancelCause(context.Background())
+	return ctx, true
+}
+
+// endFinish records how finishing the upload went. A session cancelled in the
+// meantime stays cancelled, and a file that still made it into FinalStorage is
+// deleted again.
+func (upload *ChunkedUpload) endFinish(err error) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	upload.cancelFinish = nil
+	if upload.State == StateCancelled {
+		if err == nil {
+			FinalStorage.Delete(upload.storedName())
+			deleteFileRecord(upload.storedName())
+			forgetStoredFile(upload.storedName())
+		}
+		return
+	}
+
+	upload.State = StateCompleted
+	upload.touch()
+	upload.Error = ""
+	if err != nil {
+		upload.State = StateFailed
+		upload.Error = err.Error()
+	} else {
+		upload.queueRelay()
+	}
+	saveManifest(upload)
+	upload.publishState()
+}
+
+// cancelled reports whether the client cancelled the upload.
+func (upload *ChunkedUpload) cancelled() bool {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+	return upload.State == StateCancelled
+}
+
+// contextReader fails reads once ctx is done, so copying a large file stops
+// soon after the upload is cancelled.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if c.ctx.Err() != nil {
+		return 0, context.Cause(c.ctx)
+	}
+	return c.r.Read(p)
+}
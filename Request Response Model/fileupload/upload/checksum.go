@@ -0,0 +1,63 @@
+package upload
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// ErrChecksumMismatch is returned when uploaded bytes do not match the
+// SHA-256 digest the client declared for them.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// ErrInvalidChecksum is returned when a declared checksum is not a hex
+// encoded SHA-256 digest.
+var ErrInvalidChecksum = errors.New("checksum must be a hex encoded SHA-256 digest")
+
+func newHash() hash.Hash {
+	return sha256.New()
+}
+
+// validChecksum reports whether s looks like a hex encoded SHA-256 digest.
+// An empty string means the client did not send one.
+func validChecksum(s string) bool {
+	if s == "" {
+		return true
+	}
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// verifyChecksum compares the digest accumulated in h with the expected hex
+// digest. A missing expected value skips verification.
+func verifyChecksum(expected string, h hash.Hash) error {
+	if expected == "" {
+		return nil
+	}
+	actual := hex.EncodeToString(h.Sum(nil))
+	if !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("%w: expected %s, got %s", ErrChecksumMismatch, strings.ToLower(expected), actual)
+	}
+	return nil
+}
+
+// hashFile hashes the file at path. It gives up once ctx is done.
+func hashFile(ctx context.Context, path string) (hash.Hash, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hasher := newHash()
+	if _, err := io.Copy(hasher, contextReader{ctx, file}); err != nil {
+		return nil, err
+	}
+	return hasher, nil
+}
@@ -1,39 +1,67 @@
 package upload
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
+// UploadState is where a session is in its lifecycle:
+// receiving -> merging -> completed or failed. The client may cancel a
+// session at any point before it completes.
+type UploadState string
+
+const (
+	StateReceiving UploadState = "receiving" // Accepting chunks
+	StateMerging   UploadState = "merging"   // All data received, assembling the final file
+	StateCompleted UploadState = "completed" // Final file is in FinalStorage
+	StateFailed    UploadState = "failed"    // Assembly failed, see Error
+	StateCancelled UploadState = "cancelled" // Aborted by the client, data deleted
+)
+
 type ChunkedUpload struct {
-	ID                string       // Upload session ID
-	Filename          string       // Original filename
-	ReceivedChunks    map[int]bool // Track received chunks
-	ConcurrentUploads int          // Maximum parallel uploads
-	UploadedSize      int64        // Track total bytes uploaded
-	ChunkSize         int64        // Size of each chunk
-	TotalChunks       int          // Total number of chunks
-	mutex             sync.RWMutex // For thread-safe operations
+	ID                string                  // Upload session ID
+	Filename          string                  // Original filename, sanitized
+	StorageKey        string                  // Server assigned name in FinalStorage, see UseStorageKeys
+	ContentType       string                  // MIME type declared by the client, checked against the sniffed one
+	Metadata          map[string]string       // Client supplied key/value pairs, kept in the file's sidecar
+	Tags              []string                // Client supplied tags, kept in the file's sidecar
+	ReceivedChunks    map[int]bool            // Track received chunks
+	ConcurrentUploads int                     // Maximum parallel uploads, negotiated at init
+	UploadedSize      int64                   // Track total bytes uploaded
+	TotalSize         int64                   // Declared size of the whole file
+	Checksum          string                  // Optional SHA-256 of the whole file (hex)
+	ChunkSize         int64                   // Size of each chunk
+	TotalChunks       int                     // Total number of chunks
+	Tus               bool                    // Created via the tus endpoint; data is appended to one file
+	TusMetadata       string                  // Raw Upload-Metadata header, echoed back on HEAD
+	ExpiresAt         time.Time               // When the idle session may be discarded, see SessionTTL
+	State             UploadState             // Lifecycle state, see UploadState
+	ClientID          string                  // Who the upload counts against for ClientQuota
+	Error             string                  // Why the upload failed, when State is StateFailed
+	Relay             *RelayStatus            // Forwarding to an SSH destination once completed, if init named one
+	patching          bool                    // A tus PATCH is currently writing data
+	inFlight          int                     // Chunk writes currently running for this session
+	writing           map[int]bool            // Chunks being written right now, see reserveChunk
+	cancelFinish      context.CancelCauseFunc // Stops a running merge, see cancelUpload
+	mutex             sync.RWMutex            // For thread-safe operations
 }
 
 var uploadsMutex sync.RWMutex
 var activeUploads = make(map[string]*ChunkedUpload)
 
-func parseInt(s string) int {
-	i, _ := strconv.Atoi(s)
-	return i
-}
-
 func HandleChunkedUpload(w http.ResponseWriter, r *http.Request) {
 	uploadID := r.URL.Query().Get("uploadId")
-	chunkNum := parseInt(r.URL.Query().Get("chunkNum"))
 
 	// Read Lock: Multiple readers OK
 	uploadsMutex.RLock()
@@ -41,92 +69,336 @@ func HandleChunkedUpload(w http.ResponseWriter, r *http.Request) {
 	uploadsMutex.RUnlock()
 
 	if !exists {
-		http.Error(w, "Upload session not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, CodeUploadNotFound, "Upload session not found")
+		return
+	}
+
+	if upload.Tus {
+		writeError(w, http.StatusConflict, CodeWrongProtocol, "Upload session was created via tus; use PATCH on its tus URL")
+		return
+	}
+
+	// A chunk number outside the layout must never count toward completion
+	chunkNum, err := upload.parseChunkNum(r.URL.Query().Get("chunkNum"))
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
 		return
 	}
 
 	// Write Lock: Only one writer at a time
 	upload.mutex.Lock()
+	if upload.expired() {
+		upload.mutex.Unlock()
+		discardUpload(upload)
+		writeError(w, http.StatusGone, CodeUploadExpired, "Upload session expired")
+		return
+	}
+	if upload.State == StateCancelled {
+		upload.mutex.Unlock()
+		writeError(w, http.StatusGone, CodeUploadCancelled, "Upload session cancelled")
+		return
+	}
+	if upload.State == StateFailed {
+		reason := upload.Error
+		upload.mutex.Unlock()
+		writeError(w, http.StatusConflict, CodeUploadFailed, "Upload failed: "+reason)
+		return
+	}
 	if upload.ReceivedChunks[chunkNum] {
 		upload.mutex.Unlock()
-		w.WriteHeader(http.StatusOK) // Already have this chunk
+		// Already have this chunk
+		writeJSON(w, http.StatusOK, map[string]interface{}{"uploadId": upload.ID, "chunkNum": chunkNum, "status": "duplicate"})
+		return
+	}
+	// Only one request may write a given chunk; a retry that races the
+	// original is told to check back instead of writing it twice
+	if !upload.reserveChunk(chunkNum) {
+		upload.mutex.Unlock()
+		w.Header().Set("Retry-After", strconv.Itoa(RetryAfter))
+		writeError(w, http.StatusConflict, CodeChunkInProgress, fmt.Sprintf("Chunk %d is already being uploaded", chunkNum))
 		return
 	}
 	upload.mutex.Unlock()
+	defer upload.releaseChunk(chunkNum)
 
-	if err := processChunk(upload, chunkNum, r); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	release, reason := upload.acquireChunkWrite()
+	if release == nil {
+		throttle(w, reason)
+		return
+	}
+	defer release()
+
+	// Never read more than one chunk's worth of body
+	r.Body = http.MaxBytesReader(w, r.Body, upload.ChunkSize+multipartOverhead)
+
+	written, err := processChunk(upload, chunkNum, r)
+	if err != nil {
+		// The data file went away with the session
+		if upload.cancelled() {
+			writeError(w, http.StatusGone, CodeUploadCancelled, "Upload session cancelled")
+			return
+		}
+		if errors.As(err, &limitErr) {
+			writeLimitError(w, limitErr)
+			return
+		}
+		// The file itself is unacceptable; no point in taking more chunks
+		var policyErr *PolicyError
+		if errors.As(err, &policyErr) {
+			rejectUpload(upload, policyErr)
+			writeError(w, http.StatusUnsupportedMediaType, CodeContentRejected, policyErr.Error())
+			return
+		}
+		if errors.Is(err, ErrInvalidChecksum) {
+			writeError(w, http.StatusBadRequest, CodeInvalidChecksum, err.Error())
+			return
+		}
+		if errors.Is(err, ErrChecksumMismatch) {
+			writeError(w, http.StatusUnprocessableEntity, CodeChecksumMismatch, fmt.Sprintf("Chunk %d rejected: %v", chunkNum, err))
+			return
+		}
+		writeError(w, http.StatusInternalServerError, CodeInternal, err.Error())
 		return
 	}
 
 	upload.mutex.Lock()
-	upload.ReceivedChunks[chunkNum] = true                         // Mark chunk as received
-	upload.UploadedSize += upload.ChunkSize                        // Update total bytes
+	if upload.State == StateCancelled {
+		upload.mutex.Unlock()
+		writeError(w, http.StatusGone, CodeUploadCancelled, "Upload session cancelled")
+		return
+	}
+	// Count every chunk once, however often it was sent
+	if !upload.ReceivedChunks[chunkNum] {
+		upload.ReceivedChunks[chunkNum] = true // Mark chunk as received
+		upload.UploadedSize += written         // Update total bytes
+	}
 	isComplete := len(upload.ReceivedChunks) == upload.TotalChunks // Check if done
+	// The state flips to merging under this lock, so only one request ever
+	// starts the merge
+	startMerge := isComplete && upload.State == StateReceiving
+	if startMerge {
+		upload.State = StateMerging
+	}
+	upload.touch()
+	// The manifest is only rewritten when the state changes
+	if startMerge || recordChunk(upload, chunkNum) != nil {
+		saveManifest(upload)
+	}
+	publishProgress(upload.ID, "chunk", map[string]interface{}{
+		"chunkNum":       chunkNum,
+		"receivedChunks": len(upload.ReceivedChunks),
+		"totalChunks":    upload.TotalChunks,
+		"uploadedSize":   upload.UploadedSize,
+		"totalSize":      upload.TotalSize,
+	})
+	if startMerge {
+		upload.publishState()
+	}
 	upload.mutex.Unlock()
 
-	if isComplete {
-		go mergeChunks(upload) //Background Merge
+	if startMerge {
+		go runMerge(upload) //Background Merge
 	}
 
-	w.WriteHeader(http.StatusOK)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"uploadId": upload.ID, "chunkNum": chunkNum, "status": "received"})
 }
 
-func processChunk(upload *ChunkedUpload, chunkNum int, r *http.Request) error {
+// processChunk stores the chunk carried by r and returns how many bytes it
+// held.
+func processChunk(upload *ChunkedUpload, chunkNum int, r *http.Request) (int64, error) {
 	file, _, err := r.FormFile("chunk")
 	if err != nil {
-		return err
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return 0, tooLarge(CodeChunkTooLarge, "chunkSize", "request body exceeds the declared chunkSize of %d bytes", upload.ChunkSize)
+		}
+		return 0, err
 	}
 	defer file.Close()
 
-	chunkPath := filepath.Join("uploads", "temp", upload.ID, fmt.Sprintf("chunk_%d", chunkNum))
-	chunk, err := os.Create(chunkPath)
+	// Optional SHA-256 of this chunk, hex encoded
+	checksum := r.FormValue("checksum")
+	if !validChecksum(checksum) {
+		return 0, ErrInvalidChecksum
+	}
+
+	// The first chunk carries the file's magic bytes
+	var body io.Reader = file
+	if chunkNum == 0 {
+		sniffed, rest, err := sniff(file)
+		if err != nil {
+			return 0, err
+		}
+		if err := Policies["chunked"].Check(upload.Filename, upload.ContentType, sniffed); err != nil {
+			return 0, err
+		}
+		body = rest
+	}
+
+	// Write the chunk straight into its slot of the preallocated data file,
+	// so completing the upload needs no merge pass
+	dataFile, err := os.OpenFile(dataPath(upload.ID), os.O_WRONLY, 0644)
 	if err != nil {
-		return err
+		return 0, err
+	}
+	defer dataFile.Close()
+
+	// Hash while writing so the chunk is only read once
+	limit := upload.expectedChunkSize(chunkNum)
+	slot := io.NewOffsetWriter(dataFile, int64(chunkNum)*upload.ChunkSize)
+	hasher := newHash()
+	written, err := io.Copy(io.MultiWriter(slot, hasher), io.LimitReader(body, limit))
+	if err != nil {
+		return 0, err
 	}
-	defer chunk.Close()
+	// Anything past the slot would belong to the next chunk, and a short
+	// chunk would leave a hole that still counts as received
+	if _, err := io.ReadFull(body, make([]byte, 1)); err == nil {
+		return 0, tooLarge(CodeChunkTooLarge, "chunkSize", "chunk %d carries more than the %d bytes it should", chunkNum, limit)
+	}
+	if written != limit {
+		return 0, invalid(CodeChunkSizeMismatch, "chunkSize", "chunk %d has %d bytes, expected %d", chunkNum, written, limit)
+	}
+	if err := verifyChecksum(checksum, hasher); err != nil {
+		return 0, err
+	}
+
+	// The manifest marks the chunk as received right after this, so make sure
+	// its bytes are on disk first
+	if err := dataFile.Sync(); err != nil {
+		return 0, err
+	}
+	return written, nil
+}
+
+// hasAllData reports whether every byte of the upload has been received.
+// Callers must hold upload.mutex.
+func (upload *ChunkedUpload) hasAllData() bool {
+	if upload.Tus {
+		return upload.UploadedSize == upload.TotalSize
+	}
+	return len(upload.ReceivedChunks) == upload.TotalChunks
+}
 
-	_, err = io.Copy(chunk, file)
-	return err
+// runMerge finalizes the upload and records the outcome on the session, so
+// HandleUploadStatus can report a failed merge instead of losing the error.
+func runMerge(upload *ChunkedUpload) {
+	ctx, ok := upload.beginFinish()
+	if !ok {
+		return
+	}
+
+	err := mergeChunks(ctx, upload)
+	if err != nil && !errors.Is(err, ErrUploadCancelled) {
+		fmt.Printf("Merge failed for upload %s: %v\n", upload.ID, err)
+	}
+	upload.endFinish(err)
 }
 
-func mergeChunks(upload *ChunkedUpload) error {
-	// Create final directory if it doesn't exist
-	os.MkdirAll(filepath.Join("uploads", "final"), 0755)
+// rejectUpload fails a session whose content broke the policy and drops the
+// data received so far.
+func rejectUpload(upload *ChunkedUpload, err error) {
+	upload.setState(StateFailed, err)
+	removeUploadData(upload.ID)
+}
+
+// setState moves the session to state and persists the change. err is
+// recorded as the failure reason when state is StateFailed. A cancelled
+// session stays cancelled.
+func (upload *ChunkedUpload) setState(state UploadState, err error) {
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+
+	if upload.State == StateCancelled {
+		return
+	}
 
-	// Use original filename for the final file
-	finalPath := filepath.Join("uploads", "final", upload.Filename)
-	finalFile, err := os.Create(finalPath)
+	upload.State = state
+	upload.touch()
+	upload.Error = ""
 	if err != nil {
-		return err
+		upload.Error = err.Error()
 	}
-	defer finalFile.Close()
+	saveManifest(upload)
+	upload.publishState()
+}
 
-	// Merge chunks in order
-	for i := 0; i < upload.TotalChunks; i++ {
-		chunkPath := filepath.Join("uploads", "temp", upload.ID, fmt.Sprintf("chunk_%d", i))
-		chunk, err := os.Open(chunkPath)
-		if err != nil {
-			return fmt.Errorf("failed to open chunk %d: %v", i, err)
-		}
+// mergeChunks finishes a chunked upload. Every chunk was already written at
+// its offset in the data file, so this is a rename into FinalStorage.
+func mergeChunks(ctx context.Context, upload *ChunkedUpload) error {
+	return finishUpload(ctx, upload, dataPath(upload.ID))
+}
 
-		_, err = io.Copy(finalFile, chunk)
-		chunk.Close()
+// finishUpload hands a fully assembled file to FinalStorage and removes the
+// session's data from uploads/temp. The session itself and its manifest stay
+// around so its final state can still be queried. Cancelling ctx stops it.
+func finishUpload(ctx context.Context, upload *ChunkedUpload, assembledPath string) error {
+	// The file is only read when the client declared a checksum to verify.
+	// Otherwise its checksum is taken the first time someone asks for it
+	var checksum string
+	if upload.Checksum != "" {
+		hasher, err := hashFile(ctx, assembledPath)
 		if err != nil {
-			return fmt.Errorf("failed to copy chunk %d: %v", i, err)
+			return err
+		}
+		if err := verifyChecksum(upload.Checksum, hasher); err != nil {
+			return fmt.Errorf("assembled file %s: %w", upload.Filename, err)
 		}
+		checksum = hex.EncodeToString(hasher.Sum(nil))
+	}
 
-		os.Remove(chunkPath)
+	if err := storeFile(ctx, upload.storedName(), assembledPath); err != nil {
+		return err
 	}
 
-	os.RemoveAll(filepath.Join("uploads", "temp", upload.ID))
+	// Keep the original name next to a server assigned key, along with the
+	// client's metadata
+	record := fileRecord{Checksum: checksum, ClientID: upload.ClientID, Metadata: upload.Metadata, Tags: upload.Tags}
+	if upload.StorageKey != "" {
+		record.OriginalName = upload.Filename
+	}
+	if err := storeFileRecord(upload.storedName(), record); err != nil {
+		FinalStorage.Delete(upload.storedName())
+		return fmt.Errorf("unable to save file record: %v", err)
+	}
+	recordStoredFile(upload.storedName(), upload.ClientID, upload.TotalSize)
 
+	removeUploadData(upload.ID)
+	return nil
+}
+
+// storedName is the name the finished file gets in FinalStorage.
+func (upload *ChunkedUpload) storedName() string {
+	if upload.StorageKey != "" {
+		return upload.StorageKey
+	}
+	return upload.Filename
+}
+
+// removeUploadData deletes everything in the session's temp directory except
+// its manifest.
+func removeUploadData(uploadID string) {
+	entries, err := os.ReadDir(tempDir(uploadID))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.Name() != manifestName {
+			os.RemoveAll(filepath.Join(tempDir(uploadID), entry.Name()))
+		}
+	}
+}
+
+// discardUpload removes a session from activeUploads and deletes whatever it
+// still has in uploads/temp.
+func discardUpload(upload *ChunkedUpload) {
 	// Remove from active uploads
 	uploadsMutex.Lock()
 	delete(activeUploads, upload.ID)
 	uploadsMutex.Unlock()
 
-	return nil
+	os.RemoveAll(tempDir(upload.ID))
 }
 
 func HandleInitiateUpload(w http.ResponseWriter, r *http.Request) {
@@ -136,43 +408,123 @@ func HandleInitiateUpload(w http.ResponseWriter, r *http.Request) {
 		ChunkSize   int64  `json:"chunkSize"`
 		TotalChunks int    `json:"totalChunks"`
 		Replace     bool   `json:"replace"`
+		Checksum    string `json:"checksum"`          // Optional SHA-256 of the whole file
+		ContentType string `json:"contentType"`       // Optional MIME type of the file
+		Concurrency int    `json:"concurrentUploads"` // Optional number of chunks sent in parallel
+
+		Metadata map[string]string `json:"metadata"` // Optional key/value pairs stored with the file
+		Tags     []string          `json:"tags"`     // Optional tags stored with the file
+
+		Destination string `json:"destination"` // Optional SSH destination profile to forward the file to
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, err.Error())
+		return
+	}
+
+	if !validChecksum(req.Checksum) {
+		writeError(w, http.StatusBadRequest, CodeInvalidChecksum, ErrInvalidChecksum.Error())
+		return
+	}
+
+	filename, err := sanitizeFilename(req.Filename)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, err.Error())
+		return
+	}
+
+	var limitErr *LimitError
+	if err := validateChunkLayout(req.TotalSize, req.ChunkSize, req.TotalChunks); errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
 		return
 	}
 
-	// Check if file already exists
-	finalPath := filepath.Join("uploads", "final", req.Filename)
-	if _, err := os.Stat(finalPath); err == nil && !req.Replace {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"status":   "exists",
-			"message":  "File already exists",
-			"filename": req.Filename,
-		})
+	metadata, tags, err := normalizeMetadata(req.Metadata, req.Tags)
+	if errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	if req.Destination != "" {
+		if _, exists := lookupDestination(req.Destination); !exists {
+			writeErrorDetails(w, http.StatusNotFound, CodeDestinationNotFound, "Destination not found", map[string]interface{}{"name": req.Destination})
+			return
+		}
+	}
+
+	// Check if file already exists; server assigned keys never collide
+	if _, err := FinalStorage.Stat(filename); err == nil && !req.Replace && !UseStorageKeys {
+		writeErrorDetails(w, http.StatusConflict, CodeFileExists, "File already exists", map[string]interface{}{"filename": filename})
+		return
+	}
+
+	storedName, err := storageName(filename)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error assigning storage key: "+err.Error())
 		return
 	}
 
 	uploadID := fmt.Sprintf("%d", time.Now().UnixNano())
 	upload := &ChunkedUpload{
-		ID:             uploadID,
-		Filename:       req.Filename,
-		ReceivedChunks: make(map[int]bool),
-		ChunkSize:      req.ChunkSize,
-		TotalChunks:    req.TotalChunks,
+		ID:                uploadID,
+		Filename:          filename,
+		ReceivedChunks:    make(map[int]bool),
+		TotalSize:         req.TotalSize,
+		Checksum:          strings.ToLower(req.Checksum),
+		ChunkSize:         req.ChunkSize,
+		TotalChunks:       req.TotalChunks,
+		State:             StateReceiving,
+		ClientID:          clientID(r),
+		ContentType:       req.ContentType,
+		ConcurrentUploads: negotiateConcurrency(req.Concurrency),
+		Metadata:          metadata,
+		Tags:              tags,
+	}
+	if storedName != filename {
+		upload.StorageKey = storedName
+	}
+	if req.Destination != "" {
+		upload.Relay = &RelayStatus{Destination: req.Destination, State: RelayPending, Total: req.TotalSize}
 	}
+	upload.touch()
 
-	uploadsMutex.Lock()
-	activeUploads[uploadID] = upload
-	uploadsMutex.Unlock()
+	if err := registerUpload(upload); errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	if err := os.MkdirAll(tempDir(uploadID), 0755); err != nil {
+		discardUpload(upload)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error creating upload directory: "+err.Error())
+		return
+	}
 
-	os.MkdirAll(filepath.Join("uploads", "temp", uploadID), 0755)
+	// Chunks are written at their offsets into one sparse file of the final size
+	if err := createDataFile(uploadID, req.TotalSize); err != nil {
+		discardUpload(upload)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error creating upload file: "+err.Error())
+		return
+	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"uploadId": uploadID,
-		"status":   "initiated",
-	})
+	// Persist the session before handing out the ID so it survives a restart
+	if err := saveManifest(upload); err != nil {
+		discardUpload(upload)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving upload session: "+err.Error())
+		return
+	}
+
+	response := map[string]interface{}{
+		"uploadId":  uploadID,
+		"status":    "initiated",
+		"expiresAt": upload.ExpiresAt,
+		// Chunks the client may send in parallel; more get 429
+		"concurrentUploads": upload.ConcurrentUploads,
+	}
+	if upload.StorageKey != "" {
+		response["storageKey"] = upload.StorageKey
+	}
+	writeJSON(w, http.StatusOK, response)
 }
 
 func HandleUploadStatus(w http.ResponseWriter, r *http.Request) {
@@ -183,33 +535,58 @@ func HandleUploadStatus(w http.ResponseWriter, r *http.Request) {
 	uploadsMutex.RUnlock()
 
 	if !exists {
-		http.Error(w, "Upload not found", http.StatusNotFound)
+		writeError(w, http.StatusNotFound, CodeUploadNotFound, "Upload not found")
 		return
 	}
 
 	upload.mutex.RLock()
 	defer upload.mutex.RUnlock()
 
-	// Check if file exists in final directory
-	finalPath := filepath.Join("uploads", "final", upload.Filename)
-	if _, err := os.Stat(finalPath); err == nil {
-		json.NewEncoder(w).Encode(map[string]interface{}{
-			"uploadId":   uploadID,
-			"status":     "completed",
-			"filePath":   finalPath,
-			"isComplete": true,
-		})
+	// Limit the missing chunk report to a window, e.g. chunks=1000-1999
+	query := r.URL.Query().Get("chunks")
+	first, last, err := upload.parseChunkRange(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRange, err.Error())
 		return
 	}
 
 	status := map[string]interface{}{
 		"uploadId":       upload.ID,
+		"filename":       upload.Filename,
 		"receivedChunks": len(upload.ReceivedChunks),
 		"totalChunks":    upload.TotalChunks,
-		"isComplete":     len(upload.ReceivedChunks) == upload.TotalChunks,
-		"tempPath":       filepath.Join("uploads", "temp", upload.ID),
-		"status":         "in_progress",
+		"uploadedSize":   upload.UploadedSize,
+		"totalSize":      upload.TotalSize,
+		"missingSize":    upload.TotalSize - upload.UploadedSize,
+		"isComplete":     upload.State == StateCompleted,
+		"status":         upload.State,
+		"expiresAt":      upload.ExpiresAt,
+	}
+	// tus clients resume from uploadedSize; everyone else needs the gaps
+	if !upload.Tus {
+		status["missingChunks"] = upload.missingRanges(first, last)
+		if query != "" {
+			status["chunks"] = fmt.Sprintf("%d-%d", first, last)
+		}
+	}
+	if upload.StorageKey != "" {
+		status["storageKey"] = upload.StorageKey
+	}
+	if upload.Metadata != nil {
+		status["metadata"] = upload.Metadata
+	}
+	if upload.Tags != nil {
+		status["tags"] = upload.Tags
+	}
+	if upload.State == StateReceiving {
+		status["tempPath"] = tempDir(upload.ID)
+	}
+	if upload.State == StateFailed {
+		status["error"] = upload.Error
+	}
+	if upload.Relay != nil {
+		status["relay"] = *upload.Relay
 	}
 
-	json.NewEncoder(w).Encode(status)
+	writeJSON(w, http.StatusOK, status)
 }
@@ -0,0 +1,196 @@
+package upload
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	benchChunkSize = 1 << 20
+	benchChunks    = 16
+)
+
+// benchChunkBody is the multipart body of one chunk request, and its
+// Content-Type.
+func benchChunkBody(b *testing.B) ([]byte, string) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("chunk", "blob")
+	if err != nil {
+		b.Fatal(err)
+	}
+	part.Write(bytes.Repeat([]byte{'x'}, benchChunkSize))
+	form.Close()
+	return body.Bytes(), form.FormDataContentType()
+}
+
+func benchChunkRequest(body []byte, contentType string) *http.Request {
+	r := httptest.NewRequest(http.MethodPost, "/chunk", bytes.NewReader(body))
+	r.Header.Set("Content-Type", contentType)
+	return r
+}
+
+// newBenchUpload sets up session i the way HandleInitiateUpload does. A
+// checksum of the benchmark's file makes finishing verify it.
+func newBenchUpload(b *testing.B, i int, withChecksum bool) *ChunkedUpload {
+	upload := &ChunkedUpload{
+		ID:             fmt.Sprintf("bench-%d", i),
+		Filename:       fmt.Sprintf("bench-%d.bin", i),
+		ReceivedChunks: make(map[int]bool),
+		TotalSize:      benchChunkSize * benchChunks,
+		ChunkSize:      benchChunkSize,
+		TotalChunks:    benchChunks,
+		State:          StateReceiving,
+	}
+	if withChecksum {
+		upload.Checksum = sha256Hex(bytes.Repeat([]byte{'x'}, benchChunkSize*benchChunks))
+	}
+	if err := os.MkdirAll(tempDir(upload.ID), 0755); err != nil {
+		b.Fatal(err)
+	}
+	if err := createDataFile(upload.ID, upload.TotalSize); err != nil {
+		b.Fatal(err)
+	}
+	if err := saveManifest(upload); err != nil {
+		b.Fatal(err)
+	}
+	return upload
+}
+
+// benchUploads runs upload once per iteration, for a file without and with
+// a declared checksum. Each iteration gets a fresh session whose files are
+// removed again outside the timer.
+func benchUploads(b *testing.B, upload func(*ChunkedUpload, []byte, string) error) {
+	body, contentType := benchChunkBody(b)
+
+	for _, withChecksum := range []bool{false, true} {
+		name := "no checksum"
+		if withChecksum {
+			name = "checksum"
+		}
+		b.Run(name, func(b *testing.B) {
+			newChunkedTestServer(b)
+			b.SetBytes(benchChunkSize * benchChunks)
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				session := newBenchUpload(b, i, withChecksum)
+				b.StartTimer()
+
+				if err := upload(session, body, contentType); err != nil {
+					b.Fatal(err)
+				}
+
+				b.StopTimer()
+				os.RemoveAll(tempDir(session.ID))
+				FinalStorage.Delete(session.storedName())
+				deleteFileRecord(session.storedName())
+				b.StartTimer()
+			}
+		})
+	}
+}
+
+// BenchmarkChunkedUpload is the shipped path: processChunk writes every chunk
+// at its offset in the data file and fsyncs it, the chunk is appended to the
+// chunk log, and mergeChunks moves the data file into FinalStorage,
+// verifying a declared checksum on the way.
+func BenchmarkChunkedUpload(b *testing.B) {
+	benchUploads(b, func(upload *ChunkedUpload, body []byte, contentType string) error {
+		// Chunks arrive out of order
+		for chunkNum := benchChunks - 1; chunkNum >= 0; chunkNum-- {
+			written, err := processChunk(upload, chunkNum, benchChunkRequest(body, contentType))
+			if err != nil {
+				return err
+			}
+			upload.mutex.Lock()
+			upload.ReceivedChunks[chunkNum] = true
+			upload.UploadedSize += written
+			err = recordChunk(upload, chunkNum)
+			upload.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		return mergeChunks(context.Background(), upload)
+	})
+}
+
+// BenchmarkMergeCopy is the layout the chunk log and positional writes
+// replaced: every chunk is written to a file of its own and the whole
+// manifest is rewritten, then all chunks are copied into a merged file,
+// hashing it, and that file is moved into FinalStorage.
+func BenchmarkMergeCopy(b *testing.B) {
+	benchUploads(b, func(upload *ChunkedUpload, body []byte, contentType string) error {
+		chunkPath := func(chunkNum int) string {
+			return filepath.Join(tempDir(upload.ID), fmt.Sprintf("chunk_%d", chunkNum))
+		}
+
+		for chunkNum := benchChunks - 1; chunkNum >= 0; chunkNum-- {
+			file, _, err := benchChunkRequest(body, contentType).FormFile("chunk")
+			if err != nil {
+				return err
+			}
+			chunk, err := os.Create(chunkPath(chunkNum) + ".part")
+			if err != nil {
+				return err
+			}
+			hasher := newHash()
+			_, err = io.Copy(io.MultiWriter(chunk, hasher), file)
+			file.Close()
+			if closeErr := chunk.Close(); err == nil {
+				err = closeErr
+			}
+			if err == nil {
+				err = os.Rename(chunkPath(chunkNum)+".part", chunkPath(chunkNum))
+			}
+			if err != nil {
+				return err
+			}
+
+			upload.mutex.Lock()
+			upload.ReceivedChunks[chunkNum] = true
+			err = saveManifest(upload)
+			upload.mutex.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+
+		mergedPath := filepath.Join(tempDir(upload.ID), "merged")
+		merged, err := os.Create(mergedPath)
+		if err != nil {
+			return err
+		}
+		hasher := newHash()
+		for chunkNum := 0; chunkNum < benchChunks; chunkNum++ {
+			chunk, err := os.Open(chunkPath(chunkNum))
+			if err != nil {
+				merged.Close()
+				return err
+			}
+			_, err = io.Copy(io.MultiWriter(merged, hasher), chunk)
+			chunk.Close()
+			if err != nil {
+				merged.Close()
+				return err
+			}
+		}
+		if err := merged.Close(); err != nil {
+			return err
+		}
+		if err := verifyChecksum(upload.Checksum, hasher); err != nil {
+			return err
+		}
+		return storeFile(context.Background(), upload.storedName(), mergedPath)
+	})
+}
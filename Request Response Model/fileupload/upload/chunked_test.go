@@ -0,0 +1,424 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingStorage counts the files stored, not their sidecars, i.e. how
+// often a merge finished. It hides LocalStorage's MoveFile so every merge
+// goes through Put.
+type countingStorage struct {
+	Storage
+	puts atomic.Int32
+}
+
+func (s *countingStorage) Put(name string, r io.Reader, size int64) error {
+	if !strings.HasSuffix(name, sidecarSuffix) {
+		s.puts.Add(1)
+	}
+	return s.Storage.Put(name, r, size)
+}
+
+// chunkedTestServer runs the chunked and single upload handlers. arrived receives a
+// value whenever a chunk request reaches the handler.
+type chunkedTestServer struct {
+	*httptest.Server
+	storage *countingStorage
+	arrived chan struct{}
+}
+
+// newChunkedTestServer starts a chunkedTestServer in a fresh working
+// directory, since session paths are relative to uploads/.
+func newChunkedTestServer(t testing.TB) *chunkedTestServer {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range []string{"temp", "final", "staging"} {
+		if err := os.MkdirAll(filepath.Join("uploads", sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := &chunkedTestServer{
+		storage: &countingStorage{Storage: NewLocalStorage(filepath.Join("uploads", "final"), filepath.Join("uploads", "staging"))},
+		arrived: make(chan struct{}, 1024),
+	}
+	previous := FinalStorage
+	FinalStorage = server.storage
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", HandleSingleUpload)
+	mux.HandleFunc("/init", HandleInitiateUpload)
+	mux.HandleFunc("/events", HandleUploadEvents)
+	mux.HandleFunc("/chunk", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case server.arrived <- struct{}{}:
+		default:
+		}
+		HandleChunkedUpload(w, r)
+	})
+	server.Server = httptest.NewServer(mux)
+
+	t.Cleanup(func() {
+		server.Close()
+		FinalStorage = previous
+		uploadsMutex.Lock()
+		activeUploads = make(map[string]*ChunkedUpload)
+		uploadsMutex.Unlock()
+		quotaMutex.Lock()
+		storedFiles, storedBytes, streamBytes = make(map[string]fileOwner), make(map[string]int64), make(map[string]int64)
+		quotaMutex.Unlock()
+		os.Chdir(wd)
+	})
+	return server
+}
+
+func initChunkedUpload(t *testing.T, server *chunkedTestServer, filename string, totalSize, chunkSize int64) *ChunkedUpload {
+	t.Helper()
+
+	return postInit(t, server, fmt.Sprintf(`{"filename":%q,"totalSize":%d,"chunkSize":%d,"totalChunks":%d}`,
+		filename, totalSize, chunkSize, (totalSize+chunkSize-1)/chunkSize))
+}
+
+// postInit starts a chunked upload with the given init body.
+func postInit(t *testing.T, server *chunkedTestServer, body string) *ChunkedUpload {
+	t.Helper()
+
+	resp, err := http.Post(server.URL+"/init", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var envelope struct {
+		Data struct {
+			UploadID string `json:"uploadId"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&envelope); err != nil || resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		t.Fatalf("init: status %d, err %v", resp.StatusCode, err)
+	}
+
+	uploadsMutex.RLock()
+	defer uploadsMutex.RUnlock()
+	return activeUploads[envelope.Data.UploadID]
+}
+
+// gateReader blocks until gate is closed, then reports EOF.
+type gateReader struct {
+	gate <-chan struct{}
+}
+
+func (g gateReader) Read([]byte) (int, error) {
+	<-g.gate
+	return 0, io.EOF
+}
+
+// sendChunk posts one chunk, retrying while the server says to come back
+// later. The first attempt sends its body only once gate is closed, so it
+// can be made to reach the handler together with others. It returns the
+// final status code.
+func sendChunk(server *chunkedTestServer, uploadID string, chunkNum int, data []byte, gate <-chan struct{}) (int, error) {
+	for {
+		var body bytes.Buffer
+		form := multipart.NewWriter(&body)
+		part, _ := form.CreateFormFile("chunk", "blob")
+		part.Write(data)
+		form.Close()
+
+		url := fmt.Sprintf("%s/chunk?uploadId=%s&chunkNum=%d", server.URL, uploadID, chunkNum)
+		resp, err := http.Post(url, form.FormDataContentType(), io.MultiReader(gateReader{gate}, &body))
+		if err != nil {
+			return 0, err
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		// Chunk in progress elsewhere, or too many in flight
+		if resp.StatusCode == http.StatusConflict || resp.StatusCode == http.StatusTooManyRequests {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		return resp.StatusCode, nil
+	}
+}
+
+// waitForState polls until the session leaves the receiving and merging states.
+func waitForState(t *testing.T, upload *ChunkedUpload) UploadState {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		upload.mutex.RLock()
+		state := upload.State
+		upload.mutex.RUnlock()
+		if state != StateReceiving && state != StateMerging {
+			return state
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("upload did not finish")
+	return ""
+}
+
+// uploadConcurrently sends every chunk of content copies times. All first
+// attempts are in the handler before any of them sends its data.
+func uploadConcurrently(t *testing.T, server *chunkedTestServer, upload *ChunkedUpload, content []byte, copies int) {
+	t.Helper()
+
+	var wg sync.WaitGroup
+	gate := make(chan struct{})
+	requests := upload.TotalChunks * copies
+	errs := make(chan error, requests)
+	for chunkNum := 0; chunkNum < upload.TotalChunks; chunkNum++ {
+		start := int64(chunkNum) * upload.ChunkSize
+		chunk := content[start : start+upload.expectedChunkSize(chunkNum)]
+		for i := 0; i < copies; i++ {
+			wg.Add(1)
+			go func(chunkNum int) {
+				defer wg.Done()
+				status, err := sendChunk(server, upload.ID, chunkNum, chunk, gate)
+				if err == nil && status != http.StatusOK {
+					err = fmt.Errorf("chunk %d: status %d", chunkNum, status)
+				}
+				if err != nil {
+					errs <- err
+				}
+			}(chunkNum)
+		}
+	}
+	for i := 0; i < requests; i++ {
+		<-server.arrived
+	}
+	close(gate)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func checkFinished(t *testing.T, server *chunkedTestServer, upload *ChunkedUpload, content []byte) {
+	t.Helper()
+
+	if state := waitForState(t, upload); state != StateCompleted {
+		t.Fatalf("state = %s (%s), want completed", state, upload.Error)
+	}
+	upload.mutex.RLock()
+	uploaded := upload.UploadedSize
+	upload.mutex.RUnlock()
+	if uploaded != upload.TotalSize {
+		t.Errorf("UploadedSize = %d, want %d", uploaded, upload.TotalSize)
+	}
+	if puts := server.storage.puts.Load(); puts != 1 {
+		t.Errorf("merge stored the file %d times, want once", puts)
+	}
+
+	stored, err := os.ReadFile(filepath.Join("uploads", "final", upload.Filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, content) {
+		t.Error("stored file differs from what was sent")
+	}
+}
+
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = 'a' + byte(i%26)
+	}
+	return content
+}
+
+func TestDuplicateChunksCountedOnce(t *testing.T) {
+	server := newChunkedTestServer(t)
+
+	content := testContent(4*int(MinChunkSize) + 100)
+	upload := initChunkedUpload(t, server, "duplicates.txt", int64(len(content)), MinChunkSize)
+
+	uploadConcurrently(t, server, upload, content, 4)
+	checkFinished(t, server, upload, content)
+}
+
+func TestParallelChunksMergeOnce(t *testing.T) {
+	server := newChunkedTestServer(t)
+
+	content := testContent(32*int(MinChunkSize) - 1)
+	upload := initChunkedUpload(t, server, "parallel.txt", int64(len(content)), MinChunkSize)
+
+	uploadConcurrently(t, server, upload, content, 1)
+	checkFinished(t, server, upload, content)
+
+	// A chunk sent after completion changes nothing
+	opened := make(chan struct{})
+	close(opened)
+	status, err := sendChunk(server, upload.ID, 0, content[:MinChunkSize], opened)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK {
+		t.Errorf("late duplicate: status %d", status)
+	}
+	checkFinished(t, server, upload, content)
+}
+
+// errorCode returns the code of the API error in resp, if there is one.
+func errorCode(resp *http.Response) string {
+	var envelope struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.NewDecoder(resp.Body).Decode(&envelope)
+	return envelope.Error.Code
+}
+
+// postChunk sends data as chunk chunkNum, given as the raw query value, with
+// an optional checksum form field. It returns the status and error code.
+func postChunk(t *testing.T, server *chunkedTestServer, uploadID, chunkNum string, data []byte, checksum string) (int, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if checksum != "" {
+		form.WriteField("checksum", checksum)
+	}
+	part, _ := form.CreateFormFile("chunk", "blob")
+	part.Write(data)
+	form.Close()
+
+	query := url.Values{"uploadId": {uploadID}, "chunkNum": {chunkNum}}
+	resp, err := http.Post(server.URL+"/chunk?"+query.Encode(), form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, errorCode(resp)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func TestChunkRequestsRejected(t *testing.T) {
+	server := newChunkedTestServer(t)
+
+	content := testContent(3 * int(MinChunkSize))
+	upload := initChunkedUpload(t, server, "strict.txt", int64(len(content)), MinChunkSize)
+	first := content[:MinChunkSize]
+
+	tests := []struct {
+		name     string
+		chunkNum string
+		data     []byte
+		checksum string
+		status   int
+		code     string
+	}{
+		{"missing chunkNum", "", first, "", http.StatusBadRequest, CodeInvalidChunkNumber},
+		{"chunkNum abc", "abc", first, "", http.StatusBadRequest, CodeInvalidChunkNumber},
+		{"chunkNum -1", "-1", first, "", http.StatusBadRequest, CodeInvalidChunkNumber},
+		{"chunkNum +1", "+1", first, "", http.StatusBadRequest, CodeInvalidChunkNumber},
+		{"chunkNum 1.0", "1.0", first, "", http.StatusBadRequest, CodeInvalidChunkNumber},
+		{"chunkNum past the last chunk", "3", first, "", http.StatusBadRequest, CodeChunkOutOfRange},
+		{"chunkNum 9999", "9999", first, "", http.StatusBadRequest, CodeChunkOutOfRange},
+		{"chunkNum overflowing int", "99999999999999999999", first, "", http.StatusBadRequest, CodeChunkOutOfRange},
+		{"short non-final chunk", "0", first[:len(first)-1], "", http.StatusBadRequest, CodeChunkSizeMismatch},
+		{"empty chunk", "1", nil, "", http.StatusBadRequest, CodeChunkSizeMismatch},
+		{"chunk one byte too long", "0", content[:MinChunkSize+1], "", http.StatusRequestEntityTooLarge, CodeChunkTooLarge},
+		{"body past the request cap", "0", testContent(int(MinChunkSize) + multipartOverhead + 1), "", http.StatusRequestEntityTooLarge, CodeChunkTooLarge},
+		{"malformed checksum", "0", first, "xyz", http.StatusBadRequest, CodeInvalidChecksum},
+		{"checksum of other data", "0", first, sha256Hex(content[MinChunkSize : 2*MinChunkSize]), http.StatusUnprocessableEntity, CodeChecksumMismatch},
+	}
+
+	for _, test := range tests {
+		status, code := postChunk(t, server, upload.ID, test.chunkNum, test.data, test.checksum)
+		if status != test.status || code != test.code {
+			t.Errorf("%s: %d %s, want %d %s", test.name, status, code, test.status, test.code)
+		}
+	}
+
+	// None of them counted, and the chunks can still be sent properly
+	upload.mutex.RLock()
+	received, uploaded := len(upload.ReceivedChunks), upload.UploadedSize
+	upload.mutex.RUnlock()
+	if received != 0 || uploaded != 0 {
+		t.Fatalf("rejected chunks counted: %d chunks, %d bytes", received, uploaded)
+	}
+	for chunkNum := 0; chunkNum < upload.TotalChunks; chunkNum++ {
+		chunk := content[int64(chunkNum)*MinChunkSize : int64(chunkNum+1)*MinChunkSize]
+		if status, code := postChunk(t, server, upload.ID, fmt.Sprint(chunkNum), chunk, sha256Hex(chunk)); status != http.StatusOK {
+			t.Fatalf("chunk %d: %d %s", chunkNum, status, code)
+		}
+	}
+	checkFinished(t, server, upload, content)
+}
+
+func TestWholeFileChecksum(t *testing.T) {
+	content := testContent(2*int(MinChunkSize) + 10)
+
+	tests := []struct {
+		name     string
+		checksum string
+		state    UploadState
+	}{
+		{"matching", sha256Hex(content), StateCompleted},
+		{"matching in upper case", strings.ToUpper(sha256Hex(content)), StateCompleted},
+		{"mismatching", sha256Hex(content[1:]), StateFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newChunkedTestServer(t)
+			upload := postInit(t, server, fmt.Sprintf(`{"filename":"whole.txt","totalSize":%d,"chunkSize":%d,"totalChunks":3,"checksum":%q}`,
+				len(content), MinChunkSize, test.checksum))
+			uploadConcurrently(t, server, upload, content, 1)
+
+			state := waitForState(t, upload)
+			if state != test.state {
+				t.Fatalf("state = %s (%s), want %s", state, upload.Error, test.state)
+			}
+			if state == StateFailed {
+				if !strings.Contains(upload.Error, ErrChecksumMismatch.Error()) {
+					t.Errorf("failure reason %q does not name the checksum", upload.Error)
+				}
+				if puts := server.storage.puts.Load(); puts != 0 {
+					t.Errorf("a file with the wrong checksum was stored")
+				}
+				return
+			}
+
+			record, err := loadFileRecord("whole.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if record.Checksum != sha256Hex(content) {
+				t.Errorf("sidecar checksum = %q, want the verified one", record.Checksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package upload
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Concurrency limits for chunk writes. main may override them from
+// configuration.
+var (
+	MaxSessionChunks = 4  // Most chunks one session may have in flight; clients may ask for fewer
+	MaxChunkWrites   = 64 // Most chunk writes in flight across all sessions
+	RetryAfter       = 1  // Seconds a throttled client is told to wait
+)
+
+var chunkWritesMutex sync.Mutex
+var chunkWrites int
+
+// negotiateConcurrency picks the number of parallel chunks a session may
+// send: what the client asked for, capped by MaxSessionChunks.
+func negotiateConcurrency(requested int) int {
+	if requested <= 0 || requested > MaxSessionChunks {
+		return MaxSessionChunks
+	}
+	return requested
+}
+
+// acquireChunkWrite reserves a slot for one chunk write, both within the
+// session and globally. It returns a release func, or a reason for refusing.
+func (upload *ChunkedUpload) acquireChunkWrite() (func(), string) {
+	upload.mutex.Lock()
+	if upload.ConcurrentUploads > 0 && upload.inFlight >= upload.ConcurrentUploads {
+		upload.mutex.Unlock()
+		return nil, "session already has " + strconv.Itoa(upload.inFlight) + " chunks in flight"
+	}
+	upload.inFlight++
+	upload.mutex.Unlock()
+
+	chunkWritesMutex.Lock()
+	if MaxChunkWrites > 0 && chunkWrites >= MaxChunkWrites {
+		chunkWritesMutex.Unlock()
+		upload.mutex.Lock()
+		upload.inFlight--
+		upload.mutex.Unlock()
+		return nil, "server is at its limit of concurrent chunk writes"
+	}
+	chunkWrites++
+	chunkWritesMutex.Unlock()
+
+	return func() {
+		chunkWritesMutex.Lock()
+		chunkWrites--
+		chunkWritesMutex.Unlock()
+
+		upload.mutex.Lock()
+		upload.inFlight--
+		upload.mutex.Unlock()
+	}, ""
+}
+
+// reserveChunk marks chunkNum as being written and reports whether it was
+// free. Callers must hold upload.mutex.
+func (upload *ChunkedUpload) reserveChunk(chunkNum int) bool {
+	if upload.writing[chunkNum] {
+		return false
+	}
+	if upload.writing == nil {
+		upload.writing = make(map[int]bool)
+	}
+	upload.writing[chunkNum] = true
+	return true
+}
+
+// releaseChunk frees a chunk reserved with reserveChunk.
+func (upload *ChunkedUpload) releaseChunk(chunkNum int) {
+	upload.mutex.Lock()
+	delete(upload.writing, chunkNum)
+	upload.mutex.Unlock()
+}
+
+// throttle answers a request that exceeded a concurrency limit.
+func throttle(w http.ResponseWriter, reason string) {
+	w.Header().Set("Retry-After", strconv.Itoa(RetryAfter))
+	writeError(w, http.StatusTooManyRequests, CodeRateLimited, "Too many concurrent chunk uploads: "+reason)
+}
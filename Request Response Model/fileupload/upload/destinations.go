@@ -0,0 +1,396 @@
+package upload
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DestinationsFile holds the SSH destination profiles. Passwords in it are
+// encrypted with DestinationsKey.
+var DestinationsFile = filepath.Join("uploads", "destinations.json")
+
+// DestinationsKeyFile is where a generated key is kept when DestinationsKey
+// is not set. Keeping the key next to the data only protects against the
+// data file leaking on its own; set DestinationsKey in production.
+var DestinationsKeyFile = filepath.Join("uploads", "destinations.key")
+
+// DestinationsKey is the 32 byte AES-256 key for secrets at rest.
+var DestinationsKey []byte
+
+// Destination is a named SSH target, so clients can upload with
+// destination=name instead of sending credentials on every request.
+type Destination struct {
+	Name string `json:"name"`
+	SSHConfig
+
+	HasPassword bool      `json:"hasPassword,omitempty"` // Set in responses, which never include the password
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+// storedDestination is a Destination as written to DestinationsFile.
+type storedDestination struct {
+	Destination
+	EncryptedPassword string `json:"encryptedPassword,omitempty"`
+}
+
+var destinationsMutex sync.RWMutex
+var destinations = make(map[string]Destination)
+
+// LoadDestinations reads DestinationsFile. It is meant to be called once at
+// startup; a secret that cannot be decrypted, e.g. because the key changed,
+// is an error rather than a silently dropped profile.
+func LoadDestinations() (int, error) {
+	if err := loadDestinationsKey(); err != nil {
+		return 0, err
+	}
+
+	data, err := os.ReadFile(DestinationsFile)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var stored []storedDestination
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return 0, fmt.Errorf("unable to parse %s: %v", DestinationsFile, err)
+	}
+
+	destinationsMutex.Lock()
+	defer destinationsMutex.Unlock()
+	for _, entry := range stored {
+		destination := entry.Destination
+		if entry.EncryptedPassword != "" {
+			password, err := openSecret(entry.EncryptedPassword, destination.Name)
+			if err != nil {
+				return 0, fmt.Errorf("unable to decrypt password of destination %s: %v", destination.Name, err)
+			}
+			destination.Password = password
+		}
+		destinations[destination.Name] = destination
+	}
+	return len(stored), nil
+}
+
+// loadDestinationsKey makes sure DestinationsKey is set, reading or creating
+// DestinationsKeyFile if needed.
+func loadDestinationsKey() error {
+	if DestinationsKey != nil {
+		if len(DestinationsKey) != 32 {
+			return fmt.Errorf("destinations key must be 32 bytes, got %d", len(DestinationsKey))
+		}
+		return nil
+	}
+
+	key, err := os.ReadFile(DestinationsKeyFile)
+	if err == nil {
+		if len(key) != 32 {
+			return fmt.Errorf("%s must hold 32 bytes, got %d", DestinationsKeyFile, len(key))
+		}
+		DestinationsKey = key
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	key = make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	if err := os.WriteFile(DestinationsKeyFile, key, 0600); err != nil {
+		return err
+	}
+	fmt.Printf("Generated destinations key in %s\n", DestinationsKeyFile)
+	DestinationsKey = key
+	return nil
+}
+
+// sealSecret encrypts secret with AES-GCM. The destination name is
+// authenticated along with it, so a secret cannot be moved to another
+// profile by editing the file.
+func sealSecret(secret, name string) (string, error) {
+	gcm, err := destinationsCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(secret), []byte(name))
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret reverses sealSecret.
+func openSecret(sealed, name string) (string, error) {
+	gcm, err := destinationsCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return "", err
+	}
+	if len(data) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(name))
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+func destinationsCipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(DestinationsKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// saveDestinations writes every destination to DestinationsFile atomically.
+// Callers must hold destinationsMutex.
+func saveDestinations() error {
+	stored := make([]storedDestination, 0, len(destinations))
+	for _, destination := range destinations {
+		entry := storedDestination{Destination: destination}
+		entry.Password = ""
+		entry.HasPassword = false
+		if destination.Password != "" {
+			sealed, err := sealSecret(destination.Password, destination.Name)
+			if err != nil {
+				return err
+			}
+			entry.EncryptedPassword = sealed
+		}
+		stored = append(stored, entry)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Name < stored[j].Name })
+
+	data, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := DestinationsFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, DestinationsFile)
+}
+
+// lookupDestination returns the SSH config of the named destination.
+func lookupDestination(name string) (SSHConfig, bool) {
+	destinationsMutex.RLock()
+	defer destinationsMutex.RUnlock()
+
+	destination, ok := destinations[name]
+	return destination.SSHConfig, ok
+}
+
+// redacted is destination as the API shows it: without the password.
+func (destination Destination) redacted() Destination {
+	destination.HasPassword = destination.Password != ""
+	destination.Password = ""
+	return destination
+}
+
+// validateDestination checks a destination and fills in defaults.
+func validateDestination(destination *Destination) error {
+	if !validLabel(destination.Name, 64) {
+		return fmt.Errorf("name must be 1-64 letters, digits or ._-:/")
+	}
+	if destination.Host == "" || strings.ContainsAny(destination.Host, " \t/@") {
+		return fmt.Errorf("host is required and must be a hostname or IP address")
+	}
+	if destination.Port == "" {
+		destination.Port = "22"
+	}
+	if port, err := strconv.Atoi(destination.Port); err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("port must be between 1 and 65535")
+	}
+	if destination.Username == "" {
+		return fmt.Errorf("username is required")
+	}
+	if destination.RemoteDir == "" {
+		return fmt.Errorf("remoteDir is required")
+	}
+
+	switch destination.AuthMethod {
+	case "", "password":
+		destination.AuthMethod = "password"
+		destination.KeyFile = ""
+		if destination.Password == "" {
+			return fmt.Errorf("password is required for password authentication")
+		}
+	case "key":
+		destination.Password = ""
+		if destination.KeyFile == "" {
+			return fmt.Errorf("keyFile is required for key authentication")
+		}
+	default:
+		return fmt.Errorf("authMethod must be password or key")
+	}
+
+	if fingerprint := destination.HostKeyFingerprint; fingerprint != "" {
+		if !strings.HasPrefix(fingerprint, "SHA256:") {
+			fingerprint = "SHA256:" + fingerprint
+		}
+		digest, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(fingerprint, "SHA256:"))
+		if err != nil || len(digest) != 32 {
+			return fmt.Errorf("hostKeyFingerprint must be a SHA256 fingerprint as printed by ssh-keygen -l")
+		}
+		destination.HostKeyFingerprint = fingerprint
+	}
+	return nil
+}
+
+// sameEndpoint reports whether a and b, both validated, connect to the same
+// host as the same user with the same host key check.
+func sameEndpoint(a, b SSHConfig) bool {
+	return a.Host == b.Host && a.Port == b.Port && a.Username == b.Username && a.HostKeyFingerprint == b.HostKeyFingerprint
+}
+
+// HandleDestinations manages SSH destination profiles:
+//
+//	GET    /api/v1/ssh/destinations            list
+//	POST   /api/v1/ssh/destinations            create
+//	GET    /api/v1/ssh/destinations?name=x     read
+//	PUT    /api/v1/ssh/destinations?name=x     replace; an empty password keeps the old one
+//	                                           unless the host, port, username or fingerprint change
+//	DELETE /api/v1/ssh/destinations?name=x     delete
+//
+// Passwords are accepted but never returned.
+func HandleDestinations(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get("name")
+
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		destinationsMutex.RLock()
+		list := make([]Destination, 0, len(destinations))
+		for _, destination := range destinations {
+			list = append(list, destination.redacted())
+		}
+		destinationsMutex.RUnlock()
+
+		sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+		writeJSON(w, http.StatusOK, map[string]interface{}{"destinations": list})
+
+	case r.Method == http.MethodPost && name == "":
+		var destination Destination
+		if err := json.NewDecoder(r.Body).Decode(&destination); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+			return
+		}
+		if err := validateDestination(&destination); err != nil {
+			writeError(w, http.StatusBadRequest, CodeSSHConfigInvalid, err.Error())
+			return
+		}
+
+		destinationsMutex.Lock()
+		defer destinationsMutex.Unlock()
+		if _, exists := destinations[destination.Name]; exists {
+			writeErrorDetails(w, http.StatusConflict, CodeDestinationExists, "Destination already exists", map[string]interface{}{"name": destination.Name})
+			return
+		}
+		destination.CreatedAt = time.Now()
+		destination.UpdatedAt = destination.CreatedAt
+		destinations[destination.Name] = destination
+		if err := saveDestinations(); err != nil {
+			delete(destinations, destination.Name)
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving destination: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, destination.redacted())
+
+	case r.Method == http.MethodGet:
+		destinationsMutex.RLock()
+		destination, exists := destinations[name]
+		destinationsMutex.RUnlock()
+		if !exists {
+			writeError(w, http.StatusNotFound, CodeDestinationNotFound, "Destination not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, destination.redacted())
+
+	case r.Method == http.MethodPut && name != "":
+		var destination Destination
+		if err := json.NewDecoder(r.Body).Decode(&destination); err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+			return
+		}
+		if destination.Name != "" && destination.Name != name {
+			writeError(w, http.StatusBadRequest, CodeSSHConfigInvalid, "name in the body does not match the name parameter")
+			return
+		}
+		destination.Name = name
+
+		destinationsMutex.Lock()
+		defer destinationsMutex.Unlock()
+		previous, exists := destinations[name]
+		if !exists {
+			writeError(w, http.StatusNotFound, CodeDestinationNotFound, "Destination not found")
+			return
+		}
+		keptPassword := destination.Password == ""
+		if keptPassword {
+			destination.Password = previous.Password
+		}
+		if err := validateDestination(&destination); err != nil {
+			writeError(w, http.StatusBadRequest, CodeSSHConfigInvalid, err.Error())
+			return
+		}
+		// The stored password may only be reused against the host it was
+		// given for, or an update could send it somewhere else
+		if keptPassword && destination.Password != "" && !sameEndpoint(destination.SSHConfig, previous.SSHConfig) {
+			writeError(w, http.StatusBadRequest, CodeSSHConfigInvalid, "password is required when host, port, username or hostKeyFingerprint change")
+			return
+		}
+		destination.CreatedAt = previous.CreatedAt
+		destination.UpdatedAt = time.Now()
+		destinations[name] = destination
+		if err := saveDestinations(); err != nil {
+			destinations[name] = previous
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving destination: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, destination.redacted())
+
+	case r.Method == http.MethodDelete && name != "":
+		destinationsMutex.Lock()
+		defer destinationsMutex.Unlock()
+		previous, exists := destinations[name]
+		if !exists {
+			writeError(w, http.StatusNotFound, CodeDestinationNotFound, "Destination not found")
+			return
+		}
+		delete(destinations, name)
+		if err := saveDestinations(); err != nil {
+			destinations[name] = previous
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving destinations: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"name": name, "message": "Destination deleted"})
+
+	case name == "":
+		methodNotAllowed(w, "GET, POST")
+	default:
+		methodNotAllowed(w, "GET, PUT, DELETE")
+	}
+}
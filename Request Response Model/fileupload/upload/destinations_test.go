@@ -0,0 +1,175 @@
+package upload
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useDestinationsKey gives the test its own destinations file and a fresh
+// key, and empties the loaded profiles.
+func useDestinationsKey(t *testing.T) {
+	t.Helper()
+	previousFile, previousKeyFile, previousKey := DestinationsFile, DestinationsKeyFile, DestinationsKey
+	dir := t.TempDir()
+	DestinationsFile = filepath.Join(dir, "destinations.json")
+	DestinationsKeyFile = filepath.Join(dir, "destinations.key")
+	DestinationsKey = randomKey(t)
+	resetDestinations()
+	t.Cleanup(func() {
+		DestinationsFile, DestinationsKeyFile, DestinationsKey = previousFile, previousKeyFile, previousKey
+		resetDestinations()
+	})
+}
+
+func randomKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func resetDestinations() {
+	destinationsMutex.Lock()
+	destinations = make(map[string]Destination)
+	destinationsMutex.Unlock()
+}
+
+func TestSecretRoundTrip(t *testing.T) {
+	useDestinationsKey(t)
+
+	first, err := sealSecret("hunter2", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := sealSecret("hunter2", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Error("sealing twice gave the same ciphertext; the nonce is not random")
+	}
+	if strings.Contains(first, "hunter2") {
+		t.Error("sealed secret contains the plaintext")
+	}
+
+	for _, sealed := range []string{first, second} {
+		secret, err := openSecret(sealed, "backup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != "hunter2" {
+			t.Errorf("openSecret = %q, want hunter2", secret)
+		}
+	}
+}
+
+func TestSecretWrongNameOrKey(t *testing.T) {
+	useDestinationsKey(t)
+
+	sealed, err := sealSecret("hunter2", "backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copied to another profile
+	if _, err := openSecret(sealed, "other"); err == nil {
+		t.Error("secret opened under another destination name")
+	}
+
+	// Key changed
+	DestinationsKey = randomKey(t)
+	if _, err := openSecret(sealed, "backup"); err == nil {
+		t.Error("secret opened with another key")
+	}
+
+	// Not even ciphertext
+	for _, garbage := range []string{"", "bm9uY2U=", "not base64!"} {
+		if _, err := openSecret(garbage, "backup"); err == nil {
+			t.Errorf("openSecret(%q) succeeded", garbage)
+		}
+	}
+}
+
+func TestDestinationsSurviveRestart(t *testing.T) {
+	useDestinationsKey(t)
+
+	destinationsMutex.Lock()
+	destinations["backup"] = Destination{Name: "backup", SSHConfig: SSHConfig{Host: "h", Port: "22", Username: "u", Password: "hunter2", RemoteDir: "/in"}}
+	destinations["keyed"] = Destination{Name: "keyed", SSHConfig: SSHConfig{Host: "h", Port: "22", Username: "u", AuthMethod: "key", KeyFile: "/k", RemoteDir: "/in"}}
+	err := saveDestinations()
+	destinationsMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(DestinationsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("hunter2")) {
+		t.Fatalf("%s holds the password in plain text", DestinationsFile)
+	}
+
+	resetDestinations()
+	loaded, err := LoadDestinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded != 2 {
+		t.Errorf("loaded %d destinations, want 2", loaded)
+	}
+	if config, _ := lookupDestination("backup"); config.Password != "hunter2" {
+		t.Errorf("password after reload = %q", config.Password)
+	}
+	if config, _ := lookupDestination("keyed"); config.Password != "" || config.KeyFile != "/k" {
+		t.Errorf("key destination after reload = %+v", config)
+	}
+
+	// Another key must fail loudly instead of dropping the profile
+	DestinationsKey = randomKey(t)
+	resetDestinations()
+	if _, err := LoadDestinations(); err == nil || !strings.Contains(err.Error(), "backup") {
+		t.Errorf("LoadDestinations with another key: %v, want an error naming backup", err)
+	}
+}
+
+func TestDestinationSecretBoundToName(t *testing.T) {
+	useDestinationsKey(t)
+
+	destinationsMutex.Lock()
+	destinations["backup"] = Destination{Name: "backup", SSHConfig: SSHConfig{Host: "h", Username: "u", Password: "hunter2", RemoteDir: "/in"}}
+	err := saveDestinations()
+	destinationsMutex.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rename the profile in the file, keeping its sealed password
+	data, err := os.ReadFile(DestinationsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []storedDestination
+	if err := json.Unmarshal(data, &stored); err != nil {
+		t.Fatal(err)
+	}
+	stored[0].Name = "evil"
+	if data, err = json.Marshal(stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(DestinationsFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resetDestinations()
+	if _, err := LoadDestinations(); err == nil {
+		t.Error("a password moved to another profile was accepted")
+	}
+}
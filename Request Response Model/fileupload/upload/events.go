@@ -0,0 +1,235 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// progressEvent is one Server-Sent Event about an upload.
+type progressEvent struct {
+	Name string
+	Data map[string]interface{}
+}
+
+// Each subscriber gets a buffered channel; events are dropped for a client
+// that falls this far behind rather than stalling the upload.
+const progressBuffer = 64
+
+// keepAliveInterval is how often an idle stream gets a comment line, so
+// proxies do not close it.
+const keepAliveInterval = 15 * time.Second
+
+var progressMutex sync.Mutex
+var progressSubscribers = make(map[string]map[chan progressEvent]bool)
+
+// subscribeProgress registers a listener for the events of id. Call the
+// returned function to unregister it.
+func subscribeProgress(id string) (chan progressEvent, func()) {
+	events := make(chan progressEvent, progressBuffer)
+
+	progressMutex.Lock()
+	if progressSubscribers[id] == nil {
+		progressSubscribers[id] = make(map[chan progressEvent]bool)
+	}
+	progressSubscribers[id][events] = true
+	progressMutex.Unlock()
+
+	return events, func() {
+		progressMutex.Lock()
+		delete(progressSubscribers[id], events)
+		if len(progressSubscribers[id]) == 0 {
+			delete(progressSubscribers, id)
+		}
+		progressMutex.Unlock()
+	}
+}
+
+// publishProgress sends an event to everyone listening on id.
+func publishProgress(id, name string, data map[string]interface{}) {
+	progressMutex.Lock()
+	defer progressMutex.Unlock()
+
+	for events := range progressSubscribers[id] {
+		select {
+		case events <- progressEvent{Name: name, Data: data}:
+		default: // Slow client; it can catch up from the next event
+		}
+	}
+}
+
+// publishState announces the session's current state, e.g. that merging
+// started or the upload failed. A completed upload still to be relayed says
+// so, as its stream stays open for the relay events. Callers must hold
+// upload.mutex.
+func (upload *ChunkedUpload) publishState() {
+	data := map[string]interface{}{"status": upload.State}
+	if upload.State == StateFailed {
+		data["error"] = upload.Error
+	}
+	if upload.relayAhead() {
+		data["relay"] = upload.Relay.State
+	}
+	publishProgress(upload.ID, string(upload.State), data)
+}
+
+// publishRelay announces that the relay of the session started or ended.
+// Callers must hold upload.mutex.
+func (upload *ChunkedUpload) publishRelay() {
+	data := map[string]interface{}{
+		"status":      upload.Relay.State,
+		"destination": upload.Relay.Destination,
+	}
+	if upload.Relay.RemotePath != "" {
+		data["remotePath"] = upload.Relay.RemotePath
+	}
+	if upload.Relay.State == RelayFailed {
+		data["error"] = upload.Relay.Error
+	}
+	publishProgress(upload.ID, "relay", data)
+}
+
+// relayAhead reports whether the session completed and its relay has yet to
+// finish. Callers must hold upload.mutex.
+func (upload *ChunkedUpload) relayAhead() bool {
+	return upload.State == StateCompleted && upload.Relay != nil &&
+		(upload.Relay.State == RelayPending || upload.Relay.State == RelayRelaying)
+}
+
+// relayProgress returns an UploadFileViaSSH progress callback that publishes
+// a relay event under id whenever another whole percent has been sent, or,
+// if the total is not known (-1), another MiB. An empty id disables it.
+func relayProgress(id string) func(written, total int64) {
+	if id == "" {
+		return nil
+	}
+	lastStep := int64(-1)
+	return func(written, total int64) {
+		if total < 0 {
+			if step := written >> 20; step != lastStep {
+				lastStep = step
+				publishProgress(id, "relay", map[string]interface{}{"written": written})
+			}
+			return
+		}
+
+		percent := int64(100)
+		if total > 0 {
+			percent = written * 100 / total
+		}
+		if percent == lastStep {
+			return
+		}
+		lastStep = percent
+		publishProgress(id, "relay", map[string]interface{}{
+			"percent": percent,
+			"written": written,
+			"total":   total,
+		})
+	}
+}
+
+// finalEvent reports whether no more events follow event: the upload
+// completed, failed or was cancelled with no relay still to run, or its
+// relay ended.
+func finalEvent(event progressEvent) bool {
+	if event.Name == "relay" {
+		status := event.Data["status"]
+		return status == RelayCompleted || status == RelayFailed
+	}
+	switch UploadState(event.Name) {
+	case StateCompleted, StateFailed, StateCancelled:
+		_, relayAhead := event.Data["relay"]
+		return !relayAhead
+	}
+	return false
+}
+
+// HandleUploadEvents streams the progress of one upload as Server-Sent
+// Events until it completes, fails or is cancelled, and for an upload with
+// a destination until its relay ends. uploadId is either a
+// chunked or tus session, or the progressId an SSH upload was started with.
+func HandleUploadEvents(w http.ResponseWriter, r *http.Request) {
+	uploadID := r.URL.Query().Get("uploadId")
+	if uploadID == "" {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "uploadId is required")
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, CodeStreamingUnsupported, "Streaming unsupported")
+		return
+	}
+
+	// Subscribe before taking the snapshot so nothing falls in between
+	events, unsubscribe := subscribeProgress(uploadID)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	uploadsMutex.RLock()
+	upload, exists := activeUploads[uploadID]
+	uploadsMutex.RUnlock()
+
+	// Start with where the session is now, so late subscribers are in sync
+	if exists {
+		upload.mutex.RLock()
+		snapshot := map[string]interface{}{
+			"status":         upload.State,
+			"receivedChunks": len(upload.ReceivedChunks),
+			"totalChunks":    upload.TotalChunks,
+			"uploadedSize":   upload.UploadedSize,
+			"totalSize":      upload.TotalSize,
+		}
+		if upload.State == StateFailed {
+			snapshot["error"] = upload.Error
+		}
+		if upload.Relay != nil {
+			snapshot["relay"] = *upload.Relay
+		}
+		final := finalEvent(progressEvent{Name: string(upload.State)}) && !upload.relayAhead()
+		upload.mutex.RUnlock()
+
+		writeEvent(w, progressEvent{Name: "status", Data: snapshot})
+		flusher.Flush()
+		if final {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			flusher.Flush()
+		case event := <-events:
+			writeEvent(w, event)
+			flusher.Flush()
+			if finalEvent(event) {
+				return
+			}
+		}
+	}
+}
+
+// writeEvent writes event in the SSE wire format:
+// event: [name]\ndata: [json]\n\n
+func writeEvent(w http.ResponseWriter, event progressEvent) {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Name, data)
+}
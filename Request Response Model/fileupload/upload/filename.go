@@ -0,0 +1,96 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrInvalidFilename is returned for client supplied names that cannot be
+// used as a file name as is.
+var ErrInvalidFilename = errors.New("invalid filename")
+
+// UseStorageKeys makes the server store finished files under random keys
+// instead of the client's filename. The original name is kept in the file's
+// sidecar record.
+var UseStorageKeys = false
+
+const maxFilenameLength = 255
+
+// Names Windows refuses regardless of extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// sanitizeFilename normalizes a client supplied file name to Unicode NFC and
+// rejects anything that is not a plain, portable file name: path separators,
+// "." and "..", control characters, reserved device names and names that
+// collide with the server's own sidecar files.
+func sanitizeFilename(name string) (string, error) {
+	if !utf8.ValidString(name) {
+		return "", fmt.Errorf("%w: not valid UTF-8", ErrInvalidFilename)
+	}
+	name = norm.NFC.String(name)
+
+	if name == "" {
+		return "", fmt.Errorf("%w: empty name", ErrInvalidFilename)
+	}
+	if len(name) > maxFilenameLength {
+		return "", fmt.Errorf("%w: longer than %d bytes", ErrInvalidFilename, maxFilenameLength)
+	}
+	if name == "." || name == ".." {
+		return "", fmt.Errorf("%w: %q is not a file name", ErrInvalidFilename, name)
+	}
+	if strings.ContainsAny(name, `/\`) || filepath.IsAbs(name) || filepath.VolumeName(name) != "" || hasDriveLetter(name) {
+		return "", fmt.Errorf("%w: %q contains a path", ErrInvalidFilename, name)
+	}
+	for _, r := range name {
+		if unicode.IsControl(r) || r == unicode.ReplacementChar {
+			return "", fmt.Errorf("%w: %q contains control characters", ErrInvalidFilename, name)
+		}
+	}
+	if strings.TrimRight(name, ". ") != name || strings.TrimSpace(name) != name {
+		return "", fmt.Errorf("%w: %q has leading or trailing spaces or dots", ErrInvalidFilename, name)
+	}
+
+	base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+	if reservedNames[base] {
+		return "", fmt.Errorf("%w: %q is a reserved name", ErrInvalidFilename, name)
+	}
+	if strings.HasSuffix(strings.ToLower(name), sidecarSuffix) {
+		return "", fmt.Errorf("%w: names ending in %s are reserved", ErrInvalidFilename, sidecarSuffix)
+	}
+
+	return name, nil
+}
+
+// hasDriveLetter reports whether name starts like a Windows drive relative
+// path such as C:x, which filepath only recognizes when running on Windows.
+func hasDriveLetter(name string) bool {
+	return len(name) >= 2 && name[1] == ':' && ('a' <= name[0] && name[0] <= 'z' || 'A' <= name[0] && name[0] <= 'Z')
+}
+
+// storageName picks the name a finished file is stored under: the sanitized
+// filename, or a random key keeping its extension when UseStorageKeys is on.
+func storageName(filename string) (string, error) {
+	if !UseStorageKeys {
+		return filename, nil
+	}
+
+	key := make([]byte, 16)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key) + strings.ToLower(filepath.Ext(filename)), nil
+}
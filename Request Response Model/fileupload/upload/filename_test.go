@@ -0,0 +1,84 @@
+package upload
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		want string // Empty if the name must be rejected
+	}{
+		{"report.pdf", "report.pdf"},
+		{"naïve café.txt", "naïve café.txt"},
+		{".bashrc", ".bashrc"},
+		{"console.log", "console.log"},
+		{"cafe\u0301.txt", "caf\u00e9.txt"}, // NFD comes back as NFC
+
+		{"", ""},
+		{".", ""},
+		{"..", ""},
+		{"a/b", ""},
+		{`a\b`, ""},
+		{"../etc/passwd", ""},
+		{`..\windows\win.ini`, ""},
+		{"/etc/passwd", ""},
+		{"C:x", ""},
+		{`C:\x`, ""},
+		{"CON", ""},
+		{"CON.txt", ""},
+		{"lpt1", ""},
+		{"com9.tar.gz", ""},
+		{"a\x00b", ""},
+		{"a\nb", ""},
+		{"a\u0085b", ""},
+		{"trailing.", ""},
+		{"trailing ", ""},
+		{" leading", ""},
+		{"x.meta.json", ""},
+		{"X.META.JSON", ""},
+		{"\xff.txt", ""},
+		{strings.Repeat("a", maxFilenameLength+1), ""},
+	}
+
+	for _, test := range tests {
+		got, err := sanitizeFilename(test.name)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("sanitizeFilename(%q) = %q, want an error", test.name, got)
+			} else if !errors.Is(err, ErrInvalidFilename) {
+				t.Errorf("sanitizeFilename(%q): %v is not ErrInvalidFilename", test.name, err)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("sanitizeFilename(%q) = %q, %v; want %q", test.name, got, err, test.want)
+		}
+	}
+}
+
+func TestLocalStorageRejectsNestedNames(t *testing.T) {
+	root := t.TempDir()
+	storage := NewLocalStorage(filepath.Join(root, "final"), filepath.Join(root, "staging"))
+
+	for _, name := range []string{"", ".", "..", "a/b", "../escape", "/etc/passwd", "final/../escape"} {
+		if path, err := storage.path(name); !errors.Is(err, ErrInvalidFilename) {
+			t.Errorf("path(%q) = %q, %v; want ErrInvalidFilename", name, path, err)
+		}
+		if err := storage.Put(name, strings.NewReader("x"), 1); err == nil {
+			t.Errorf("Put(%q) succeeded", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "escape")); !os.IsNotExist(err) {
+		t.Errorf("a file was written outside the storage directory: %v", err)
+	}
+
+	path, err := storage.path("ok.txt")
+	if err != nil || path != filepath.Join(root, "final", "ok.txt") {
+		t.Errorf("path(ok.txt) = %q, %v", path, err)
+	}
+}
@@ -0,0 +1,297 @@
+package upload
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Page sizes for HandleListFiles.
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// storedFile is what the API tells clients about a file in FinalStorage.
+type storedFile struct {
+	Name         string    `json:"name"`
+	Size         int64     `json:"size"`
+	ModTime      time.Time `json:"modTime"`
+	Checksum     string    `json:"checksum,omitempty"`     // SHA-256, hex encoded
+	OriginalName string    `json:"originalName,omitempty"` // Set for files stored under a server assigned key
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+}
+
+// HandleListFiles lists the files in FinalStorage in name order, a page at a
+// time. cursor is the last name of the previous page. tag=x and meta.key=value
+// narrow the list to files carrying that tag or metadata value.
+func HandleListFiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	limit := defaultPageSize
+	if value := r.URL.Query().Get("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+	cursor := r.URL.Query().Get("cursor")
+	tagFilter := r.URL.Query()["tag"]
+	metaFilter := make(map[string]string)
+	for key, values := range r.URL.Query() {
+		if name, ok := strings.CutPrefix(key, "meta."); ok {
+			metaFilter[name] = values[0]
+		}
+	}
+
+	infos, err := FinalStorage.List()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error listing files: "+err.Error())
+		return
+	}
+
+	// Sidecars are bookkeeping, not files of their own
+	files := make([]storedFile, 0, limit)
+	nextCursor := ""
+	start := sort.Search(len(infos), func(i int) bool { return infos[i].Name > cursor })
+	for _, info := range infos[start:] {
+		if strings.HasSuffix(info.Name, sidecarSuffix) {
+			continue
+		}
+
+		record, _ := loadFileRecord(info.Name)
+		if !record.matches(tagFilter, metaFilter) {
+			continue
+		}
+		if len(files) == limit {
+			nextCursor = files[len(files)-1].Name
+			break
+		}
+
+		file, err := describeFile(info, record)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error reading "+info.Name+": "+err.Error())
+			return
+		}
+		files = append(files, file)
+	}
+
+	response := map[string]interface{}{"files": files}
+	if nextCursor != "" {
+		response["nextCursor"] = nextCursor
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// HandleFileMetadata describes one stored file.
+func HandleFileMetadata(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	info, ok := statRequestedFile(w, r)
+	if !ok {
+		return
+	}
+
+	record, _ := loadFileRecord(info.Name)
+	file, err := describeFile(info, record)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error reading "+info.Name+": "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"file": file,
+		"etag": fileETag(info),
+	})
+}
+
+// HandleDownload serves a stored file. http.ServeContent takes care of
+// Range and If-Range, so interrupted downloads can resume, and of
+// If-None-Match and If-Modified-Since for caches.
+func HandleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		methodNotAllowed(w, "GET, HEAD")
+		return
+	}
+
+	info, ok := statRequestedFile(w, r)
+	if !ok {
+		return
+	}
+
+	content, err := openSeekable(info)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error opening "+info.Name+": "+err.Error())
+		return
+	}
+	defer content.Close()
+
+	downloadName := info.Name
+	if record, err := loadFileRecord(info.Name); err == nil && record.OriginalName != "" {
+		downloadName = record.OriginalName
+	}
+
+	// Never let a browser render uploaded content inline
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": downloadName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", fileETag(info))
+	http.ServeContent(w, r, info.Name, info.ModTime, content)
+}
+
+// statRequestedFile looks up the file named by the name query parameter. It
+// answers the request itself and returns false if there is none.
+func statRequestedFile(w http.ResponseWriter, r *http.Request) (FileInfo, bool) {
+	name, err := sanitizeFilename(r.URL.Query().Get("name"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, err.Error())
+		return FileInfo{}, false
+	}
+
+	info, err := FinalStorage.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		writeError(w, http.StatusNotFound, CodeFileNotFound, "File not found")
+		return FileInfo{}, false
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error reading "+name+": "+err.Error())
+		return FileInfo{}, false
+	}
+	return info, true
+}
+
+// describeFile adds what the file's sidecar record holds to info.
+func describeFile(info FileInfo, record fileRecord) (storedFile, error) {
+	// Files stored without a checksum are hashed once, on first request, and
+	// the result is saved to their record
+	if record.Checksum == "" {
+		checksum, err := storedChecksum(info)
+		if err != nil {
+			return storedFile{}, err
+		}
+		record.Checksum = checksum
+		if err := saveFileRecord(info.Name, record); err != nil {
+			fmt.Printf("Unable to save checksum of %s: %v\n", info.Name, err)
+		}
+	}
+
+	return storedFile{
+		Name:         info.Name,
+		Size:         info.Size,
+		ModTime:      info.ModTime,
+		Checksum:     record.Checksum,
+		OriginalName: record.OriginalName,
+		Metadata:     record.Metadata,
+		Tags:         record.Tags,
+	}, nil
+}
+
+// fileETag identifies one version of a stored file. It is derived from size
+// and modification time so serving a download never has to hash the file
+// first.
+func fileETag(info FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size, info.ModTime.UnixNano())
+}
+
+// storedChecksum returns the SHA-256 of a stored file by reading all of it.
+func storedChecksum(info FileInfo) (string, error) {
+	file, err := FinalStorage.Open(info.Name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hasher := newHash()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// openSeekable opens a stored file for http.ServeContent, which needs to
+// seek. Backends that cannot seek are read with ranged requests instead.
+func openSeekable(info FileInfo) (io.ReadSeekCloser, error) {
+	if ranger, ok := FinalStorage.(rangeOpener); ok {
+		return &rangeReader{storage: ranger, name: info.Name, size: info.Size}, nil
+	}
+
+	file, err := FinalStorage.Open(info.Name)
+	if err != nil {
+		return nil, err
+	}
+	if seeker, ok := file.(io.ReadSeekCloser); ok {
+		return seeker, nil
+	}
+	file.Close()
+	return nil, fmt.Errorf("storage cannot serve partial reads of %s", info.Name)
+}
+
+// rangeReader is an io.ReadSeeker over a rangeOpener. Seeking is free; the
+// next Read opens the file at the new offset.
+type rangeReader struct {
+	storage rangeOpener
+	name    string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.storage.OpenRange(r.name, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	return n, err
+}
+
+func (r *rangeReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	}
+	if offset < 0 {
+		return 0, errors.New("seek before start of file")
+	}
+	if offset != r.offset {
+		r.Close()
+		r.offset = offset
+	}
+	return offset, nil
+}
+
+func (r *rangeReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,135 @@
+package upload
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// HostKeyMode decides what happens when an SSH host presents a key that is
+// not in KnownHostsFile.
+type HostKeyMode string
+
+const (
+	HostKeyStrict HostKeyMode = "strict" // Refuse unknown hosts
+	HostKeyTOFU   HostKeyMode = "tofu"   // Trust on first use: record the key and connect
+)
+
+// KnownHostsFile holds the trusted host keys, in OpenSSH known_hosts format.
+var KnownHostsFile = filepath.Join("uploads", "known_hosts")
+
+// SSHHostKeyMode applies to hosts without a pinned fingerprint.
+var SSHHostKeyMode = HostKeyStrict
+
+// knownHostsMutex serialises reading and recording keys, so two first
+// connections to the same host cannot both append it.
+var knownHostsMutex sync.Mutex
+
+// HostKey describes the key an SSH server presented.
+type HostKey struct {
+	Type        string `json:"keyType"`
+	Fingerprint string `json:"fingerprint"` // SHA256:..., as printed by ssh-keygen -l
+}
+
+func describeHostKey(key ssh.PublicKey) HostKey {
+	return HostKey{Type: key.Type(), Fingerprint: ssh.FingerprintSHA256(key)}
+}
+
+// HostKeyError means a host was refused because its key is not trusted.
+// Mismatch is true if a different key is trusted for the host, which is
+// what a man-in-the-middle looks like.
+type HostKeyError struct {
+	Host     string
+	Key      HostKey
+	Mismatch bool
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Mismatch {
+		return fmt.Sprintf("host key for %s does not match the trusted key (presented %s %s)", e.Host, e.Key.Type, e.Key.Fingerprint)
+	}
+	return fmt.Sprintf("host key for %s is not trusted (presented %s %s)", e.Host, e.Key.Type, e.Key.Fingerprint)
+}
+
+// hostKeyCallback verifies the server's key against config.HostKeyFingerprint
+// if set, and against KnownHostsFile otherwise. The presented key is stored
+// in presented either way, so callers can show it to an operator.
+func hostKeyCallback(config SSHConfig, presented *HostKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		*presented = describeHostKey(key)
+
+		if pinned := config.HostKeyFingerprint; pinned != "" {
+			if !strings.HasPrefix(pinned, "SHA256:") {
+				pinned = "SHA256:" + pinned
+			}
+			if pinned != presented.Fingerprint {
+				return &HostKeyError{Host: hostname, Key: *presented, Mismatch: true}
+			}
+			return nil
+		}
+
+		knownHostsMutex.Lock()
+		defer knownHostsMutex.Unlock()
+
+		check, err := loadKnownHosts()
+		if err != nil {
+			return err
+		}
+
+		err = check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return &HostKeyError{Host: hostname, Key: *presented, Mismatch: true}
+		}
+
+		if SSHHostKeyMode != HostKeyTOFU {
+			return &HostKeyError{Host: hostname, Key: *presented}
+		}
+		if err := recordHostKey(hostname, key); err != nil {
+			return fmt.Errorf("unable to record host key: %v", err)
+		}
+		fmt.Printf("Trusted new host key for %s: %s %s\n", hostname, presented.Type, presented.Fingerprint)
+		return nil
+	}
+}
+
+// loadKnownHosts parses KnownHostsFile, creating it empty if it does not
+// exist yet. It is read on every connection so edits apply without a restart.
+func loadKnownHosts() (ssh.HostKeyCallback, error) {
+	file, err := os.OpenFile(KnownHostsFile, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open known hosts: %v", err)
+	}
+	file.Close()
+
+	check, err := knownhosts.New(KnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read known hosts: %v", err)
+	}
+	return check, nil
+}
+
+// recordHostKey appends key for hostname to KnownHostsFile. Callers must hold
+// knownHostsMutex.
+func recordHostKey(hostname string, key ssh.PublicKey) error {
+	file, err := os.OpenFile(KnownHostsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(file, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,342 @@
+package upload
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sshTestServer is an in-process SSH server that accepts user u with
+// password pw. Its host key can be swapped to play a changed or spoofed host.
+// Sessions get an SFTP subsystem on the real file system, and the one exec
+// command relays use to hash a remote prefix.
+type sshTestServer struct {
+	host, port string
+	received   atomic.Int64 // Bytes of SFTP requests received over all connections
+
+	mutex     sync.Mutex
+	key       ssh.Signer
+	drops     int   // Connections still to be cut...
+	dropAfter int64 // ...once they received this many bytes of SFTP requests
+}
+
+func newHostKey(t *testing.T) ssh.Signer {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startSSHTestServer(t *testing.T) *sshTestServer {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	server := &sshTestServer{key: newHostKey(t)}
+	server.host, server.port, _ = net.SplitHostPort(listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *sshTestServer) serve(conn net.Conn) {
+	defer conn.Close()
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "u" && string(password) == "pw" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(s.hostKey())
+	drop := s.takeDrop()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn, channel, requests, drop)
+	}
+}
+
+// session runs the SFTP subsystem or the exec command a session asks for.
+func (s *sshTestServer) session(conn net.Conn, channel ssh.Channel, requests <-chan *ssh.Request, drop int64) {
+	defer channel.Close()
+
+	for request := range requests {
+		var payload struct{ Value string }
+		ssh.Unmarshal(request.Payload, &payload)
+
+		switch {
+		case request.Type == "subsystem" && payload.Value == "sftp":
+			request.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			server, err := sftp.NewServer(&droppingChannel{Channel: channel, server: s, conn: conn, drop: drop})
+			if err == nil {
+				server.Serve()
+			}
+			return
+		case request.Type == "exec":
+			request.Reply(true, nil)
+			go ssh.DiscardRequests(requests)
+			status := execPrefixHash(channel, payload.Value)
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+var prefixHashCommand = regexp.MustCompile(`^head -c (\d+) '([^']*)' \| sha256sum$`)
+
+// execPrefixHash answers the command remotePrefixHash sends, as head and
+// sha256sum would, and fails any other. It returns the exit status.
+func execPrefixHash(channel ssh.Channel, command string) uint32 {
+	match := prefixHashCommand.FindStringSubmatch(command)
+	if match == nil {
+		fmt.Fprintf(channel.Stderr(), "unsupported command: %s\n", command)
+		return 127
+	}
+	n, _ := strconv.ParseInt(match[1], 10, 64)
+	file, err := os.Open(match[2])
+	if err != nil {
+		fmt.Fprintln(channel.Stderr(), err)
+		return 1
+	}
+	defer file.Close()
+
+	hasher := sha256.New()
+	io.Copy(hasher, io.LimitReader(file, n))
+	fmt.Fprintf(channel, "%x  -\n", hasher.Sum(nil))
+	return 0
+}
+
+// droppingChannel counts the SFTP requests a connection receives and cuts
+// the connection once drop bytes came in, if drop is set.
+type droppingChannel struct {
+	ssh.Channel
+	server *sshTestServer
+	conn   net.Conn
+	drop   int64
+	read   int64
+}
+
+func (c *droppingChannel) Read(p []byte) (int, error) {
+	n, err := c.Channel.Read(p)
+	c.read += int64(n)
+	c.server.received.Add(int64(n))
+	if c.drop > 0 && c.read >= c.drop {
+		c.conn.Close()
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// dropConnections makes the next count connections fail once they received
+// after bytes of SFTP requests.
+func (s *sshTestServer) dropConnections(count int, after int64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.drops, s.dropAfter = count, after
+}
+
+func (s *sshTestServer) takeDrop() int64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.drops == 0 {
+		return 0
+	}
+	s.drops--
+	return s.dropAfter
+}
+
+func (s *sshTestServer) hostKey() ssh.Signer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.key
+}
+
+func (s *sshTestServer) setHostKey(key ssh.Signer) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.key = key
+}
+
+func (s *sshTestServer) fingerprint() string {
+	return ssh.FingerprintSHA256(s.hostKey().PublicKey())
+}
+
+func (s *sshTestServer) config() SSHConfig {
+	return SSHConfig{Host: s.host, Port: s.port, Username: "u", Password: "pw", AuthMethod: "password"}
+}
+
+// useKnownHosts points KnownHostsFile at an empty file of the test's own and
+// sets the host key mode.
+func useKnownHosts(t *testing.T, mode HostKeyMode) {
+	t.Helper()
+	previousFile, previousMode := KnownHostsFile, SSHHostKeyMode
+	KnownHostsFile = filepath.Join(t.TempDir(), "known_hosts")
+	SSHHostKeyMode = mode
+	t.Cleanup(func() {
+		KnownHostsFile, SSHHostKeyMode = previousFile, previousMode
+	})
+}
+
+func knownHostsLines(t *testing.T) []string {
+	t.Helper()
+	data, err := os.ReadFile(KnownHostsFile)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if text := strings.TrimSpace(string(data)); text != "" {
+		return strings.Split(text, "\n")
+	}
+	return nil
+}
+
+// expectHostKeyError checks that err refused the server's current key, as a
+// mismatch or as an unknown host.
+func expectHostKeyError(t *testing.T, server *sshTestServer, err error, mismatch bool) {
+	t.Helper()
+	var hostKeyErr *HostKeyError
+	if !errors.As(err, &hostKeyErr) {
+		t.Fatalf("error = %v, want a HostKeyError", err)
+	}
+	if hostKeyErr.Mismatch != mismatch {
+		t.Errorf("Mismatch = %v, want %v", hostKeyErr.Mismatch, mismatch)
+	}
+	if hostKeyErr.Key.Fingerprint != server.fingerprint() {
+		t.Errorf("reported fingerprint %s, server presented %s", hostKeyErr.Key.Fingerprint, server.fingerprint())
+	}
+}
+
+func TestHostKeyStrictRefusesUnknownHost(t *testing.T) {
+	server := startSSHTestServer(t)
+	useKnownHosts(t, HostKeyStrict)
+
+	_, err := TestSSHConnection(server.config())
+	expectHostKeyError(t, server, err, false)
+	if lines := knownHostsLines(t); len(lines) != 0 {
+		t.Errorf("strict mode recorded a key: %v", lines)
+	}
+}
+
+func TestHostKeyPinned(t *testing.T) {
+	server := startSSHTestServer(t)
+	useKnownHosts(t, HostKeyStrict)
+
+	// With and without the SHA256: prefix, as users copy it either way
+	for _, pin := range []string{server.fingerprint(), strings.TrimPrefix(server.fingerprint(), "SHA256:")} {
+		config := server.config()
+		config.HostKeyFingerprint = pin
+		hostKey, err := TestSSHConnection(config)
+		if err != nil {
+			t.Fatalf("pin %s: %v", pin, err)
+		}
+		if hostKey.Fingerprint != server.fingerprint() || hostKey.Type != ssh.KeyAlgoED25519 {
+			t.Errorf("presented key = %+v", hostKey)
+		}
+	}
+	if lines := knownHostsLines(t); len(lines) != 0 {
+		t.Errorf("a pinned connection recorded a key: %v", lines)
+	}
+}
+
+func TestHostKeyWrongPin(t *testing.T) {
+	server := startSSHTestServer(t)
+	// A pin overrides trust on first use
+	useKnownHosts(t, HostKeyTOFU)
+
+	config := server.config()
+	config.HostKeyFingerprint = ssh.FingerprintSHA256(newHostKey(t).PublicKey())
+	_, err := TestSSHConnection(config)
+	expectHostKeyError(t, server, err, true)
+	if lines := knownHostsLines(t); len(lines) != 0 {
+		t.Errorf("a refused key was recorded: %v", lines)
+	}
+}
+
+func TestHostKeyTOFURecordsKey(t *testing.T) {
+	server := startSSHTestServer(t)
+	useKnownHosts(t, HostKeyTOFU)
+
+	if _, err := TestSSHConnection(server.config()); err != nil {
+		t.Fatal(err)
+	}
+	if lines := knownHostsLines(t); len(lines) != 1 {
+		t.Fatalf("known_hosts has %d lines after first use, want 1", len(lines))
+	}
+
+	// The recorded key is now trusted in strict mode too, and not recorded twice
+	SSHHostKeyMode = HostKeyStrict
+	if _, err := TestSSHConnection(server.config()); err != nil {
+		t.Fatalf("recorded key not trusted: %v", err)
+	}
+	if lines := knownHostsLines(t); len(lines) != 1 {
+		t.Errorf("known_hosts has %d lines, want 1", len(lines))
+	}
+}
+
+func TestHostKeyChangedAfterTOFU(t *testing.T) {
+	server := startSSHTestServer(t)
+	useKnownHosts(t, HostKeyTOFU)
+
+	if _, err := TestSSHConnection(server.config()); err != nil {
+		t.Fatal(err)
+	}
+	recorded := knownHostsLines(t)
+
+	// Same host and port, different key: what a man-in-the-middle looks like
+	server.setHostKey(newHostKey(t))
+	_, err := TestSSHConnection(server.config())
+	expectHostKeyError(t, server, err, true)
+	if lines := knownHostsLines(t); strings.Join(lines, "\n") != strings.Join(recorded, "\n") {
+		t.Errorf("known_hosts changed after a mismatch:\n%v\nwas\n%v", lines, recorded)
+	}
+}
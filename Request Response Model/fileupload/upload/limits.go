@@ -0,0 +1,132 @@
+package upload
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Server side limits. main may override them from configuration; a value of
+// 0 disables the corresponding check.
+var (
+	MaxFileSize  int64 = 10 << 30 // Largest file accepted by any endpoint
+	MinChunkSize int64 = 64 << 10 // Smallest declared chunk size, unless the file fits in one chunk
+	MaxChunkSize int64 = 64 << 20 // Largest declared chunk size
+	ClientQuota  int64 = 50 << 30 // Bytes one client may have stored and in unfinished uploads, see quota.go
+)
+
+// multipartOverhead is the slack allowed on top of the payload for multipart
+// boundaries and headers when capping request bodies.
+const multipartOverhead = 1 << 20
+
+// LimitError reports a request that breaks one of the server side limits.
+// Limit names the violated limit so clients can tell them apart.
+type LimitError struct {
+	Limit   string // e.g. "maxFileSize"
+	Code    string // API error code, e.g. CodeFileTooLarge
+	Status  int    // HTTP status to answer with, 400 or 413
+	Message string
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Limit, e.Message)
+}
+
+func tooLarge(code, limit, format string, args ...interface{}) *LimitError {
+	return &LimitError{Limit: limit, Code: code, Status: http.StatusRequestEntityTooLarge, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalid(code, limit, format string, args ...interface{}) *LimitError {
+	return &LimitError{Limit: limit, Code: code, Status: http.StatusBadRequest, Message: fmt.Sprintf(format, args...)}
+}
+
+// checkFileSize rejects files larger than MaxFileSize.
+func checkFileSize(size int64) error {
+	if MaxFileSize > 0 && size > MaxFileSize {
+		return tooLarge(CodeFileTooLarge, "maxFileSize", "file size %d exceeds the limit of %d bytes", size, MaxFileSize)
+	}
+	return nil
+}
+
+// validateChunkLayout checks the sizes a client declares when starting a
+// chunked upload against the server limits and against each other.
+func validateChunkLayout(totalSize, chunkSize int64, totalChunks int) error {
+	if totalSize <= 0 {
+		return invalid(CodeInvalidChunkLayout, "totalSize", "totalSize must be positive, got %d", totalSize)
+	}
+	if err := checkFileSize(totalSize); err != nil {
+		return err
+	}
+	if chunkSize <= 0 {
+		return invalid(CodeInvalidChunkLayout, "chunkSize", "chunkSize must be positive, got %d", chunkSize)
+	}
+	if MaxChunkSize > 0 && chunkSize > MaxChunkSize {
+		return tooLarge(CodeInvalidChunkLayout, "maxChunkSize", "chunkSize %d exceeds the limit of %d bytes", chunkSize, MaxChunkSize)
+	}
+	// Small chunks are fine when the whole file fits in one of them
+	if chunkSize < MinChunkSize && chunkSize < totalSize {
+		return invalid(CodeInvalidChunkLayout, "minChunkSize", "chunkSize %d is below the minimum of %d bytes", chunkSize, MinChunkSize)
+	}
+
+	expected := (totalSize + chunkSize - 1) / chunkSize
+	if int64(totalChunks) != expected {
+		return invalid(CodeInvalidChunkLayout, "totalChunks", "totalChunks %d does not match totalSize %d / chunkSize %d (expected %d)",
+			totalChunks, totalSize, chunkSize, expected)
+	}
+	return nil
+}
+
+// expectedChunkSize is the number of bytes chunk chunkNum must carry: the
+// declared ChunkSize, except for the last chunk which gets the remainder.
+func (upload *ChunkedUpload) expectedChunkSize(chunkNum int) int64 {
+	if chunkNum == upload.TotalChunks-1 {
+		return upload.TotalSize - int64(upload.TotalChunks-1)*upload.ChunkSize
+	}
+	return upload.ChunkSize
+}
+
+// parseChunkNum parses the chunkNum query parameter strictly: plain decimal
+// digits naming a chunk inside 0..TotalChunks-1. Anything else is rejected
+// rather than read as chunk 0.
+func (upload *ChunkedUpload) parseChunkNum(s string) (int, error) {
+	if s == "" {
+		return 0, invalid(CodeInvalidChunkNumber, "chunkNum", "chunkNum is required")
+	}
+	if strings.TrimLeft(s, "0123456789") != "" {
+		return 0, invalid(CodeInvalidChunkNumber, "chunkNum", "chunkNum %q is not a non-negative integer", s)
+	}
+	chunkNum, err := strconv.Atoi(s)
+	if err != nil || chunkNum >= upload.TotalChunks {
+		return 0, invalid(CodeChunkOutOfRange, "chunkNum", "chunk %s is outside 0..%d", s, upload.TotalChunks-1)
+	}
+	return chunkNum, nil
+}
+
+// clientID identifies who a request counts against for quotas: its remote
+// IP. Nothing the client sends is trusted for this, or it could pick a new
+// identity for every upload and never reach its quota.
+func clientID(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// registerUpload adds upload to activeUploads if its owner stays within
+// ClientQuota. Check and insert happen under one lock so concurrent inits
+// cannot both squeeze past the quota.
+func registerUpload(upload *ChunkedUpload) error {
+	uploadsMutex.Lock()
+	defer uploadsMutex.Unlock()
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	if err := checkQuota(upload.ClientID, upload.TotalSize); err != nil {
+		return err
+	}
+	activeUploads[upload.ID] = upload
+	return nil
+}
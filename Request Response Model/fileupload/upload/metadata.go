@@ -0,0 +1,102 @@
+package upload
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Bounds on client supplied metadata, which ends up in every sidecar and
+// listing.
+const (
+	maxMetadataKeys   = 64
+	maxMetadataKeyLen = 128
+	maxMetadataValLen = 1024
+	maxTags           = 32
+	maxTagLen         = 64
+)
+
+// validLabel reports whether s is usable as a metadata key or tag: letters,
+// digits and . _ - : / only, so pipelines can match on them without
+// escaping.
+func validLabel(s string, maxLen int) bool {
+	if s == "" || len(s) > maxLen {
+		return false
+	}
+	for _, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("._-:/", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeMetadata validates client metadata and tags. Tags come back
+// trimmed, deduplicated and sorted.
+func normalizeMetadata(metadata map[string]string, tags []string) (map[string]string, []string, error) {
+	if len(metadata) > maxMetadataKeys {
+		return nil, nil, invalid(CodeInvalidMetadata, "metadata", "at most %d metadata keys are allowed, got %d", maxMetadataKeys, len(metadata))
+	}
+	for key, value := range metadata {
+		if !validLabel(key, maxMetadataKeyLen) {
+			return nil, nil, invalid(CodeInvalidMetadata, "metadata", "metadata key %q must be 1-%d letters, digits or ._-:/", key, maxMetadataKeyLen)
+		}
+		if len(value) > maxMetadataValLen || !utf8.ValidString(value) {
+			return nil, nil, invalid(CodeInvalidMetadata, "metadata", "metadata value for %q must be valid UTF-8 of at most %d bytes", key, maxMetadataValLen)
+		}
+	}
+	if len(metadata) == 0 {
+		metadata = nil
+	}
+
+	seen := make(map[string]bool)
+	var normalized []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if !validLabel(tag, maxTagLen) {
+			return nil, nil, invalid(CodeInvalidMetadata, "tags", "tag %q must be 1-%d letters, digits or ._-:/", tag, maxTagLen)
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalized = append(normalized, tag)
+		}
+	}
+	if len(normalized) > maxTags {
+		return nil, nil, invalid(CodeInvalidMetadata, "tags", "at most %d tags are allowed, got %d", maxTags, len(normalized))
+	}
+	sort.Strings(normalized)
+
+	return metadata, normalized, nil
+}
+
+// parseFormMetadata reads metadata and tags from a multipart form: metadata
+// as a JSON object of strings, tags as one or more comma separated lists.
+func parseFormMetadata(form map[string][]string) (map[string]string, []string, error) {
+	var metadata map[string]string
+	if raw := form["metadata"]; len(raw) > 0 && raw[0] != "" {
+		if err := json.Unmarshal([]byte(raw[0]), &metadata); err != nil {
+			return nil, nil, invalid(CodeInvalidMetadata, "metadata", "metadata must be a JSON object of strings: %v", err)
+		}
+	}
+
+	var tags []string
+	for _, list := range form["tags"] {
+		for _, tag := range strings.Split(list, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+
+	return normalizeMetadata(metadata, tags)
+}
+
+// hasTag reports whether tags, as returned by normalizeMetadata, contain tag.
+func hasTag(tags []string, tag string) bool {
+	i := sort.SearchStrings(tags, tag)
+	return i < len(tags) && tags[i] == tag
+}
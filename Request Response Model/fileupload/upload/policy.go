@@ -0,0 +1,180 @@
+package upload
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// sniffLen is how many leading bytes are inspected. http.DetectContentType
+// only looks at the first 512, but the PE header of a Windows executable is
+// usually further in.
+const sniffLen = 4096
+
+// ContentPolicy decides what an endpoint accepts based on the type sniffed
+// from a file's leading bytes. Entries are MIME types ("application/pdf") or
+// prefixes ending in a slash ("image/").
+type ContentPolicy struct {
+	Allow        []string // If set, only these types are accepted
+	Deny         []string // Never accepted, checked before Allow
+	RequireMatch bool     // Sniffed type must agree with the declared extension and MIME type
+}
+
+// Types that can run on their own; denied everywhere by default. Scripts
+// (text/x-shellscript) are recognized but not denied, since they are plain
+// text that needs an interpreter; add them to a Deny list to refuse them.
+var executableTypes = []string{
+	"application/x-executable",
+	"application/x-mach-binary",
+	"application/vnd.microsoft.portable-executable",
+}
+
+// Policies holds the content policy per endpoint: "single", "chunked", "tus"
+// and "ssh". main may replace them from configuration.
+var Policies = map[string]*ContentPolicy{
+	"single":  {Deny: executableTypes, RequireMatch: true},
+	"chunked": {Deny: executableTypes, RequireMatch: true},
+	"tus":     {Deny: executableTypes, RequireMatch: true},
+	"ssh":     {Deny: executableTypes, RequireMatch: true},
+}
+
+// PolicyError explains why a file was refused. Handlers answer it with 415.
+type PolicyError struct {
+	Reason string
+}
+
+func (e *PolicyError) Error() string {
+	return "unsupported content: " + e.Reason
+}
+
+// Signatures http.DetectContentType does not know about
+var extraSignatures = []struct {
+	magic    []byte
+	mimeType string
+}{
+	{[]byte("\x7fELF"), "application/x-executable"},
+	{[]byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{[]byte("\xfe\xed\xfa\xcf"), "application/x-mach-binary"},
+	{[]byte("#!"), "text/x-shellscript"},
+}
+
+// detectContentType returns the MIME type of data without parameters.
+func detectContentType(data []byte) string {
+	if isPortableExecutable(data) {
+		return "application/vnd.microsoft.portable-executable"
+	}
+	for _, sig := range extraSignatures {
+		if bytes.HasPrefix(data, sig.magic) {
+			return sig.mimeType
+		}
+	}
+	return essence(http.DetectContentType(data))
+}
+
+// isPortableExecutable reports whether data starts a Windows PE file: an MZ
+// header whose e_lfanew field at 0x3c points at a "PE\0\0" signature. Text
+// that merely starts with "MZ" does not qualify.
+func isPortableExecutable(data []byte) bool {
+	if len(data) < 0x40 || !bytes.HasPrefix(data, []byte("MZ")) {
+		return false
+	}
+	offset := int64(binary.LittleEndian.Uint32(data[0x3c:]))
+	return offset+4 <= int64(len(data)) && bytes.Equal(data[offset:offset+4], []byte("PE\x00\x00"))
+}
+
+// sniff detects the type of r's leading bytes and returns a reader that still
+// yields the whole stream.
+func sniff(r io.Reader) (string, io.Reader, error) {
+	br := bufio.NewReaderSize(r, sniffLen)
+	head, err := br.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return "", nil, err
+	}
+	return detectContentType(head), br, nil
+}
+
+func essence(mimeType string) string {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(mimeType))
+	}
+	return mediaType
+}
+
+func matchesAny(mimeType string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == mimeType || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(mimeType, pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMagic reports whether files of this type start with a signature the
+// sniffer recognizes, so a disagreement with the declared type means
+// something is off rather than that sniffing is inconclusive.
+func hasMagic(mimeType string) bool {
+	switch {
+	case strings.HasPrefix(mimeType, "image/"), strings.HasPrefix(mimeType, "audio/"),
+		strings.HasPrefix(mimeType, "video/"), strings.HasPrefix(mimeType, "font/"):
+		return true
+	}
+	switch mimeType {
+	case "application/pdf", "application/zip", "application/x-gzip", "application/gzip",
+		"application/x-rar-compressed", "application/wasm", "application/ogg":
+		return true
+	}
+	return matchesAny(mimeType, executableTypes)
+}
+
+// compatible reports whether a declared type and a sniffed type can describe
+// the same file.
+func compatible(declared, sniffed string) bool {
+	if declared == "" || declared == "application/octet-stream" || declared == sniffed {
+		return true
+	}
+	// Office documents, jars, epubs and friends are zip files inside
+	if sniffed == "application/zip" && (strings.HasSuffix(declared, "+zip") ||
+		strings.HasPrefix(declared, "application/vnd.openxmlformats") ||
+		strings.HasPrefix(declared, "application/vnd.oasis.opendocument") ||
+		declared == "application/java-archive" || declared == "application/epub+zip") {
+		return true
+	}
+	if declared == "application/gzip" && sniffed == "application/x-gzip" {
+		return true
+	}
+	return !hasMagic(declared) && !hasMagic(sniffed)
+}
+
+// Check applies the policy to a file named filename whose client declared
+// MIME type is declaredType (may be empty) and whose sniffed type is sniffed.
+func (p *ContentPolicy) Check(filename, declaredType, sniffed string) error {
+	if p == nil {
+		return nil
+	}
+
+	if matchesAny(sniffed, p.Deny) {
+		return &PolicyError{Reason: fmt.Sprintf("%s content is not accepted", sniffed)}
+	}
+	if len(p.Allow) > 0 && !matchesAny(sniffed, p.Allow) {
+		return &PolicyError{Reason: fmt.Sprintf("%s content is not in the allowed types", sniffed)}
+	}
+
+	if p.RequireMatch {
+		if byExt := essence(mime.TypeByExtension(filepath.Ext(filename))); byExt != "" && !compatible(byExt, sniffed) {
+			return &PolicyError{Reason: fmt.Sprintf("content looks like %s but the extension of %q says %s", sniffed, filename, byExt)}
+		}
+		if declared := essence(declaredType); declared != "" && !compatible(declared, sniffed) {
+			return &PolicyError{Reason: fmt.Sprintf("content looks like %s but was declared as %s", sniffed, declared)}
+		}
+	}
+
+	return nil
+}
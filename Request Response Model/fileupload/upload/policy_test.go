@@ -0,0 +1,167 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// peHeader returns an MZ header whose e_lfanew points at offset, padded to
+// size bytes, with a PE signature at offset if it fits.
+func peHeader(offset uint32, size int) []byte {
+	data := make([]byte, size)
+	copy(data, "MZ")
+	binary.LittleEndian.PutUint32(data[0x3c:], offset)
+	if int64(offset)+4 <= int64(size) {
+		copy(data[offset:], "PE\x00\x00")
+	}
+	return data
+}
+
+var (
+	pdfBytes = []byte("%PDF-1.7\n1 0 obj\n<< /Type /Catalog >>\nendobj\n")
+	pngBytes = append([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"), make([]byte, 32)...)
+	zipBytes = append([]byte("PK\x03\x04\x14\x00\x00\x00"), make([]byte, 32)...)
+)
+
+func TestIsPortableExecutable(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want bool
+	}{
+		{"real PE header", peHeader(0x80, 512), true},
+		{"signature at the end of the sniff window", peHeader(sniffLen-4, sniffLen), true},
+		{"text starting with MZ", []byte(strings.Repeat("MZ is a postcode in a plain text file. ", 4)), false},
+		{"MZ without a PE signature", peHeader(0x80, 512)[:0x80], false},
+		{"e_lfanew past the sniff window", peHeader(sniffLen, sniffLen), false},
+		{"e_lfanew at the largest offset", peHeader(0xffffffff, sniffLen), false},
+		{"shorter than an MZ header", []byte("MZ\x90\x00"), false},
+		{"PE signature without MZ", append([]byte("ZM"), peHeader(0x80, 512)[2:]...), false},
+	}
+
+	for _, test := range tests {
+		if got := isPortableExecutable(test.data); got != test.want {
+			t.Errorf("%s: isPortableExecutable = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSniffedTypes(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"PE", peHeader(0x80, 8192), "application/vnd.microsoft.portable-executable"},
+		{"text starting with MZ", []byte("MZ is a postcode\n"), "text/plain"},
+		{"ELF", []byte("\x7fELF\x02\x01\x01"), "application/x-executable"},
+		{"shell script", []byte("#!/bin/sh\necho hi\n"), "text/x-shellscript"},
+		{"PDF", pdfBytes, "application/pdf"},
+		{"zip", zipBytes, "application/zip"},
+	}
+
+	for _, test := range tests {
+		sniffed, body, err := sniff(bytes.NewReader(test.data))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if sniffed != test.want {
+			t.Errorf("%s: sniffed %s, want %s", test.name, sniffed, test.want)
+		}
+		// Sniffing must not eat into the data
+		var rest bytes.Buffer
+		rest.ReadFrom(body)
+		if !bytes.Equal(rest.Bytes(), test.data) {
+			t.Errorf("%s: reader after sniffing yields %d bytes, want %d", test.name, rest.Len(), len(test.data))
+		}
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		declared, sniffed string
+		want              bool
+	}{
+		{"", "application/pdf", true},
+		{"application/octet-stream", "application/x-executable", true},
+		{"application/pdf", "application/pdf", true},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/zip", true},
+		{"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", "application/zip", true},
+		{"application/vnd.oasis.opendocument.text", "application/zip", true},
+		{"application/java-archive", "application/zip", true},
+		{"application/epub+zip", "application/zip", true},
+		{"application/vnd.google-earth.kmz+zip", "application/zip", true},
+		{"application/gzip", "application/x-gzip", true},
+		{"text/csv", "text/plain", true}, // Neither has a signature to go by
+
+		{"image/png", "application/pdf", false},
+		{"application/pdf", "image/png", false},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", "application/pdf", false},
+		{"application/zip", "application/vnd.microsoft.portable-executable", false},
+		{"text/plain", "application/x-executable", false},
+	}
+
+	for _, test := range tests {
+		if got := compatible(test.declared, test.sniffed); got != test.want {
+			t.Errorf("compatible(%q, %q) = %v, want %v", test.declared, test.sniffed, got, test.want)
+		}
+	}
+}
+
+func TestContentPolicyCheck(t *testing.T) {
+	const (
+		pe   = "application/vnd.microsoft.portable-executable"
+		pdf  = "application/pdf"
+		png  = "image/png"
+		zip  = "application/zip"
+		docx = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	)
+	defaults := &ContentPolicy{Deny: executableTypes, RequireMatch: true}
+
+	tests := []struct {
+		name     string
+		policy   *ContentPolicy
+		filename string
+		declared string
+		sniffed  string
+		ok       bool
+		reason   string // Part of the refusal's reason, if it matters
+	}{
+		{"no policy", nil, "setup.exe", "", pe, true, ""},
+		{"default denies PE", defaults, "setup.exe", "", pe, false, ""},
+		{"default denies PE under another name", defaults, "notes.txt", "text/plain", pe, false, ""},
+		{"default accepts scripts", defaults, "run.sh", "", "text/x-shellscript", true, ""},
+		{"default accepts text starting with MZ", defaults, "postcodes.txt", "text/plain", "text/plain", true, ""},
+		{"png name over PDF bytes", defaults, "photo.png", "", pdf, false, ""},
+		{"png name over PDF bytes, match not required", &ContentPolicy{}, "photo.png", "", pdf, true, ""},
+		{"declared png over PDF bytes", defaults, "photo", png, pdf, false, ""},
+		{"declared type with parameters", defaults, "doc.pdf", "application/pdf; charset=binary", pdf, true, ""},
+		{"docx over zip bytes", defaults, "report.docx", docx, zip, true, ""},
+		{"docx over PDF bytes", defaults, "report", docx, pdf, false, ""},
+
+		{"deny wins over allow", &ContentPolicy{Allow: []string{pdf}, Deny: []string{pdf}}, "a.pdf", "", pdf, false, "is not accepted"},
+		{"deny prefix wins over allowed type", &ContentPolicy{Allow: []string{png}, Deny: []string{"image/"}}, "a.png", "", png, false, "is not accepted"},
+		{"allow prefix", &ContentPolicy{Allow: []string{"image/"}}, "a.png", "", png, true, ""},
+		{"allow prefix excludes other types", &ContentPolicy{Allow: []string{"image/"}}, "a.pdf", "", pdf, false, "not in the allowed types"},
+		{"prefix needs its slash", &ContentPolicy{Allow: []string{"image"}}, "a.png", "", png, false, ""},
+		{"entries ignore case and spaces", &ContentPolicy{Deny: []string{" Application/PDF "}}, "a.pdf", "", pdf, false, ""},
+	}
+
+	for _, test := range tests {
+		err := test.policy.Check(test.filename, test.declared, test.sniffed)
+		if test.ok && err != nil {
+			t.Errorf("%s: %v, want accepted", test.name, err)
+		}
+		if !test.ok {
+			var policyErr *PolicyError
+			if !errors.As(err, &policyErr) {
+				t.Errorf("%s: %v, want a PolicyError", test.name, err)
+			} else if !strings.Contains(policyErr.Reason, test.reason) {
+				t.Errorf("%s: refused because %s, want %q", test.name, policyErr.Reason, test.reason)
+			}
+		}
+	}
+}
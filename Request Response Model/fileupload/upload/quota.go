@@ -0,0 +1,163 @@
+package upload
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ClientQuota covers everything a client holds on this server: the files it
+// stored, the declared size of its unfinished chunked and tus sessions, and
+// the bytes of single and SSH uploads it is sending right now. Lock
+// uploadsMutex before quotaMutex.
+var (
+	quotaMutex  sync.Mutex
+	storedFiles = make(map[string]fileOwner) // Stored file name -> who it counts against
+	storedBytes = make(map[string]int64)     // Client -> size of the files it stored
+	streamBytes = make(map[string]int64)     // Client -> bytes received so far by its single and SSH uploads
+)
+
+// fileOwner is who a stored file counts against for ClientQuota, and how much.
+type fileOwner struct {
+	ClientID string
+	Size     int64
+}
+
+// LoadStoredUsage counts the files in FinalStorage against the clients their
+// sidecars name. Files stored before owners were recorded count against
+// nobody. It returns how many files were counted.
+func LoadStoredUsage() (int, error) {
+	files, err := FinalStorage.List()
+	if err != nil {
+		return 0, err
+	}
+
+	counted := 0
+	for _, info := range files {
+		if strings.HasSuffix(info.Name, sidecarSuffix) {
+			continue
+		}
+		record, err := loadFileRecord(info.Name)
+		if errors.Is(err, os.ErrNotExist) || err == nil && record.ClientID == "" {
+			continue
+		}
+		if err != nil {
+			return counted, err
+		}
+		recordStoredFile(info.Name, record.ClientID, info.Size)
+		counted++
+	}
+	return counted, nil
+}
+
+// recordStoredFile counts the file just stored as name against client. A
+// file it replaced no longer counts against its owner.
+func recordStoredFile(name, client string, size int64) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	forgetStoredFileLocked(name)
+	if client == "" {
+		return
+	}
+	storedFiles[name] = fileOwner{ClientID: client, Size: size}
+	storedBytes[client] += size
+}
+
+// forgetStoredFile stops counting a stored file that was deleted again.
+func forgetStoredFile(name string) {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	forgetStoredFileLocked(name)
+}
+
+func forgetStoredFileLocked(name string) {
+	owner, exists := storedFiles[name]
+	if !exists {
+		return
+	}
+	delete(storedFiles, name)
+	if storedBytes[owner.ClientID] -= owner.Size; storedBytes[owner.ClientID] <= 0 {
+		delete(storedBytes, owner.ClientID)
+	}
+}
+
+// checkQuota returns a LimitError if client holding size more bytes would
+// exceed ClientQuota. Callers hold uploadsMutex, for reading at least, and
+// quotaMutex.
+func checkQuota(client string, size int64) error {
+	if ClientQuota <= 0 {
+		return nil
+	}
+
+	used := storedBytes[client] + streamBytes[client]
+	for _, other := range activeUploads {
+		other.mutex.RLock()
+		if other.ClientID == client && (other.State == StateReceiving || other.State == StateMerging) {
+			used += other.TotalSize
+		}
+		other.mutex.RUnlock()
+	}
+	if used+size > ClientQuota {
+		return tooLarge(CodeQuotaExceeded, "clientQuota", "client %s holds %d bytes in stored files and unfinished uploads; %d more exceeds the quota of %d bytes",
+			client, used, size, ClientQuota)
+	}
+	return nil
+}
+
+// quotaReservation holds the bytes of one single or SSH upload against its
+// client while the request runs. release gives them back; by then a stored
+// file counts through recordStoredFile instead.
+type quotaReservation struct {
+	client string
+	bytes  int64
+}
+
+// reserve adds n bytes to the reservation, unless that exceeds the quota.
+func (q *quotaReservation) reserve(n int64) error {
+	uploadsMutex.RLock()
+	defer uploadsMutex.RUnlock()
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	if err := checkQuota(q.client, n); err != nil {
+		return err
+	}
+	q.bytes += n
+	streamBytes[q.client] += n
+	return nil
+}
+
+func (q *quotaReservation) release() {
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+
+	if streamBytes[q.client] -= q.bytes; streamBytes[q.client] <= 0 {
+		delete(streamBytes, q.client)
+	}
+	q.bytes = 0
+}
+
+// reader reserves the bytes read through it as they arrive, for uploads
+// whose size is not known up front. The read that would exceed the quota
+// fails with a LimitError.
+func (q *quotaReservation) reader(r io.Reader) io.Reader {
+	return &quotaReader{reservation: q, r: r}
+}
+
+type quotaReader struct {
+	reservation *quotaReservation
+	r           io.Reader
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	n, err := q.r.Read(p)
+	if n > 0 {
+		if quotaErr := q.reservation.reserve(int64(n)); quotaErr != nil {
+			return 0, quotaErr
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,98 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// postSingleUpload sends content to the single upload endpoint and returns
+// the status and error code of the answer.
+func postSingleUpload(t *testing.T, server *chunkedTestServer, filename string, content []byte) (int, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, _ := form.CreateFormFile("file", filename)
+	part.Write(content)
+	form.Close()
+
+	resp, err := http.Post(server.URL+"/upload", form.FormDataContentType(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, errorCode(resp)
+}
+
+func useClientQuota(t *testing.T, quota int64) {
+	t.Helper()
+	previous := ClientQuota
+	ClientQuota = quota
+	t.Cleanup(func() { ClientQuota = previous })
+}
+
+func TestClientQuotaCountsStoredFiles(t *testing.T) {
+	server := newChunkedTestServer(t)
+	useClientQuota(t, 1000)
+	content := testContent(600)
+
+	if status, code := postSingleUpload(t, server, "first.txt", content); status != http.StatusOK {
+		t.Fatalf("first upload: status %d %s", status, code)
+	}
+
+	// The stored file still counts, through whichever endpoint comes next
+	if status, code := postSingleUpload(t, server, "second.txt", content); status != http.StatusRequestEntityTooLarge || code != CodeQuotaExceeded {
+		t.Errorf("single upload over quota: status %d %s", status, code)
+	}
+	body := fmt.Sprintf(`{"filename":"third.txt","totalSize":%d,"chunkSize":%d,"totalChunks":1}`, len(content), len(content))
+	resp, err := http.Post(server.URL+"/init", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("chunked init over quota: status %d", resp.StatusCode)
+	}
+
+	// A failed upload gives back what it reserved
+	quotaMutex.Lock()
+	streaming := len(streamBytes)
+	quotaMutex.Unlock()
+	if streaming != 0 {
+		t.Errorf("reservations left after the requests: %v", streamBytes)
+	}
+
+	// After a restart the count comes back from the sidecars
+	quotaMutex.Lock()
+	storedFiles, storedBytes = make(map[string]fileOwner), make(map[string]int64)
+	quotaMutex.Unlock()
+	counted, err := LoadStoredUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counted != 1 || storedBytes["127.0.0.1"] != int64(len(content)) {
+		t.Errorf("after reload: %d file(s) counted, usage %v", counted, storedBytes)
+	}
+}
+
+func TestClientQuotaCountsCompletedSessions(t *testing.T) {
+	server := newChunkedTestServer(t)
+	content := testContent(2*int(MinChunkSize) + 1)
+	useClientQuota(t, int64(len(content))+100)
+
+	upload := initChunkedUpload(t, server, "chunked.txt", int64(len(content)), MinChunkSize)
+	uploadConcurrently(t, server, upload, content, 1)
+	checkFinished(t, server, upload, content)
+
+	// Finishing the session does not free its bytes
+	if status, code := postSingleUpload(t, server, "more.txt", testContent(200)); status != http.StatusRequestEntityTooLarge || code != CodeQuotaExceeded {
+		t.Errorf("single upload after a completed session: status %d %s", status, code)
+	}
+	if status, code := postSingleUpload(t, server, "small.txt", testContent(50)); status != http.StatusOK {
+		t.Errorf("upload within quota: status %d %s", status, code)
+	}
+}
@@ -0,0 +1,91 @@
+package upload
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SessionTTL is how long an upload session is kept after its last activity
+// (init, a received chunk or PATCH, or a state change). Expired sessions are
+// rejected and eventually deleted by the reaper together with their chunks.
+var SessionTTL = 24 * time.Hour
+
+// touch pushes the session's expiry out by SessionTTL. Callers must hold
+// upload.mutex.
+func (upload *ChunkedUpload) touch() {
+	upload.ExpiresAt = time.Now().Add(SessionTTL)
+}
+
+// expired reports whether the session outlived its TTL. Callers must hold
+// upload.mutex.
+func (upload *ChunkedUpload) expired() bool {
+	return !upload.ExpiresAt.IsZero() && time.Now().After(upload.ExpiresAt)
+}
+
+// StartReaper deletes expired sessions and abandoned temp directories every
+// interval until the process exits.
+func StartReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if reaped := reapExpiredSessions(); reaped > 0 {
+				fmt.Printf("Reaped %d expired upload session(s)\n", reaped)
+			}
+		}
+	}()
+}
+
+func reapExpiredSessions() int {
+	var expired []*ChunkedUpload
+
+	uploadsMutex.RLock()
+	for _, upload := range activeUploads {
+		upload.mutex.RLock()
+		// Never pull the data out from under a running merge or PATCH
+		busy := upload.State == StateMerging || upload.patching
+		if !busy && upload.expired() {
+			expired = append(expired, upload)
+		}
+		upload.mutex.RUnlock()
+	}
+	uploadsMutex.RUnlock()
+
+	for _, upload := range expired {
+		discardUpload(upload)
+	}
+
+	return len(expired) + reapOrphanedTempDirs()
+}
+
+// reapOrphanedTempDirs removes directories in uploads/temp that belong to no
+// session, e.g. ones whose manifest could not be loaded, once they have been
+// idle for longer than SessionTTL.
+func reapOrphanedTempDirs() int {
+	entries, err := os.ReadDir(filepath.Join("uploads", "temp"))
+	if err != nil {
+		return 0
+	}
+
+	reaped := 0
+	for _, entry := range entries {
+		uploadsMutex.RLock()
+		_, active := activeUploads[entry.Name()]
+		uploadsMutex.RUnlock()
+		if active {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < SessionTTL {
+			continue
+		}
+		if os.RemoveAll(filepath.Join("uploads", "temp", entry.Name())) == nil {
+			reaped++
+		}
+	}
+	return reaped
+}
@@ -0,0 +1,84 @@
+package upload
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// sidecarSuffix marks the record FinalStorage keeps next to each finished
+// file, e.g. report.pdf and report.pdf.meta.json.
+const sidecarSuffix = ".meta.json"
+
+// fileRecord is the sidecar stored next to a finished file.
+type fileRecord struct {
+	Checksum     string            `json:"checksum,omitempty"`     // SHA-256 of the file, hex encoded, once verified or first asked for
+	OriginalName string            `json:"originalName,omitempty"` // Name the client uploaded the file as, if stored under a key
+	ClientID     string            `json:"clientId,omitempty"`     // Who stored the file, counted against ClientQuota
+	Metadata     map[string]string `json:"metadata,omitempty"`     // Client supplied key/value pairs
+	Tags         []string          `json:"tags,omitempty"`         // Client supplied tags, sorted
+}
+
+// storeFileRecord saves the sidecar for name, or removes a stale one left by
+// a replaced file when there is nothing to record. It is called once the file
+// itself is stored, so a file that failed to store never gets a record, and
+// a replaced file's record is never swapped for one of a failed upload.
+func storeFileRecord(name string, record fileRecord) error {
+	if record.Checksum == "" && record.OriginalName == "" && record.ClientID == "" && len(record.Metadata) == 0 && len(record.Tags) == 0 {
+		return deleteFileRecord(name)
+	}
+	if err := saveFileRecord(name, record); err != nil {
+		// Better no record than the one of the file this replaced
+		deleteFileRecord(name)
+		return err
+	}
+	return nil
+}
+
+// deleteFileRecord removes the sidecar for name, if there is one.
+func deleteFileRecord(name string) error {
+	if err := FinalStorage.Delete(name + sidecarSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// saveFileRecord writes the sidecar for the stored file name.
+func saveFileRecord(name string, record fileRecord) error {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	return FinalStorage.Put(name+sidecarSuffix, bytes.NewReader(data), int64(len(data)))
+}
+
+// loadFileRecord reads the sidecar for the stored file name.
+func loadFileRecord(name string) (fileRecord, error) {
+	var record fileRecord
+
+	file, err := FinalStorage.Open(name + sidecarSuffix)
+	if err != nil {
+		return record, err
+	}
+	defer file.Close()
+
+	err = json.NewDecoder(file).Decode(&record)
+	return record, err
+}
+
+// matches reports whether the record carries every tag and metadata value
+// asked for.
+func (record fileRecord) matches(tags []string, metadata map[string]string) bool {
+	for _, tag := range tags {
+		if !hasTag(record.Tags, tag) {
+			return false
+		}
+	}
+	for key, value := range metadata {
+		if actual, ok := record.Metadata[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,156 @@
+package upload
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sync"
+)
+
+// RelayState is where forwarding a finished chunked upload to its SSH
+// destination stands: pending -> relaying -> completed or failed.
+type RelayState string
+
+const (
+	RelayPending   RelayState = "pending"   // Waiting for the upload to finish, or for a free relay slot
+	RelayRelaying  RelayState = "relaying"  // Copying to the destination
+	RelayCompleted RelayState = "completed" // File is on the destination
+	RelayFailed    RelayState = "failed"    // Gave up, see Error
+)
+
+// RelayStatus reports the forwarding of an upload to its destination.
+type RelayStatus struct {
+	Destination string     `json:"destination"`
+	State       RelayState `json:"status"`
+	Written     int64      `json:"written"`
+	Total       int64      `json:"total"`
+	RemotePath  string     `json:"remotePath,omitempty"`
+	Error       string     `json:"error,omitempty"`
+}
+
+// MaxRelays is how many finished uploads are forwarded over SSH at once;
+// the rest wait in RelayPending. 0 means no limit.
+var MaxRelays = 2
+
+var relaysMutex sync.Mutex
+var relaysFree = sync.NewCond(&relaysMutex)
+var relaysRunning int
+
+// localFiler is implemented by backends that keep files on local disk,
+// which can then be relayed in place.
+type localFiler interface {
+	LocalPath(name string) (string, error)
+}
+
+// queueRelay schedules forwarding a completed upload to its destination.
+// Callers must hold upload.mutex.
+func (upload *ChunkedUpload) queueRelay() {
+	if upload.Relay == nil {
+		return
+	}
+	upload.Relay.State = RelayPending
+	upload.Relay.Written = 0
+	upload.Relay.Error = ""
+	go runRelay(upload)
+}
+
+// runRelay copies the upload's stored file to its destination once a relay
+// slot is free. UploadFileViaSSH retries and resumes as configured.
+func runRelay(upload *ChunkedUpload) {
+	relaysMutex.Lock()
+	for MaxRelays > 0 && relaysRunning >= MaxRelays {
+		relaysFree.Wait()
+	}
+	relaysRunning++
+	relaysMutex.Unlock()
+	defer func() {
+		relaysMutex.Lock()
+		relaysRunning--
+		relaysMutex.Unlock()
+		relaysFree.Signal()
+	}()
+
+	upload.mutex.Lock()
+	if upload.State != StateCompleted || upload.Relay == nil {
+		upload.mutex.Unlock()
+		return
+	}
+	upload.Relay.State = RelayRelaying
+	destination := upload.Relay.Destination
+	filename, storedName := upload.Filename, upload.storedName()
+	upload.touch()
+	saveManifest(upload)
+	upload.publishRelay()
+	upload.mutex.Unlock()
+
+	err := relayStoredFile(upload, destination, filename, storedName)
+
+	upload.mutex.Lock()
+	defer upload.mutex.Unlock()
+	upload.Relay.State = RelayCompleted
+	if err != nil {
+		fmt.Printf("\nRelay of upload %s to %s failed: %v\n", upload.ID, destination, err)
+		upload.Relay.State = RelayFailed
+		upload.Relay.Error = err.Error()
+	}
+	upload.touch()
+	saveManifest(upload)
+	upload.publishRelay()
+}
+
+// relayStoredFile sends the stored file of upload to the named destination
+// under its original filename.
+func relayStoredFile(upload *ChunkedUpload, destination, filename, storedName string) error {
+	config, exists := lookupDestination(destination)
+	if !exists {
+		return fmt.Errorf("destination %s not found", destination)
+	}
+
+	localPath, cleanup, err := relaySource(storedName)
+	if err != nil {
+		return fmt.Errorf("unable to read stored file: %v", err)
+	}
+	defer cleanup()
+
+	upload.mutex.Lock()
+	upload.Relay.RemotePath = path.Join(config.RemoteDir, filename)
+	upload.mutex.Unlock()
+
+	progress := relayProgress(upload.ID)
+	return UploadFileViaSSH(config, localPath, filename, func(written, total int64) {
+		upload.mutex.Lock()
+		upload.Relay.Written = written
+		upload.Relay.Total = total
+		upload.mutex.Unlock()
+		progress(written, total)
+	})
+}
+
+// relaySource returns a local path holding the stored file. Backends that
+// are not on local disk are downloaded to a temporary file first, which
+// the returned func removes.
+func relaySource(name string) (string, func(), error) {
+	if filer, ok := FinalStorage.(localFiler); ok {
+		localPath, err := filer.LocalPath(name)
+		return localPath, func() {}, err
+	}
+
+	stored, err := FinalStorage.Open(name)
+	if err != nil {
+		return "", nil, err
+	}
+	defer stored.Close()
+
+	tempFile, err := os.CreateTemp("", "ssh-relay-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, stored); err != nil {
+		os.Remove(tempFile.Name())
+		return "", nil, err
+	}
+	return tempFile.Name(), func() { os.Remove(tempFile.Name()) }, nil
+}
@@ -0,0 +1,118 @@
+package upload
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// readEvents follows the event stream of uploadID until the server ends it.
+// ready is closed once the opening snapshot arrived, i.e. the stream is
+// subscribed.
+func readEvents(t *testing.T, server *chunkedTestServer, uploadID string, ready chan<- struct{}) []progressEvent {
+	resp, err := http.Get(server.URL + "/events?uploadId=" + uploadID)
+	if err != nil {
+		t.Error(err)
+		close(ready)
+		return nil
+	}
+	defer resp.Body.Close()
+
+	var events []progressEvent
+	var name string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if value, ok := strings.CutPrefix(line, "event: "); ok {
+			name = value
+		} else if value, ok := strings.CutPrefix(line, "data: "); ok {
+			event := progressEvent{Name: name}
+			json.Unmarshal([]byte(value), &event.Data)
+			events = append(events, event)
+			if len(events) == 1 {
+				close(ready)
+			}
+		}
+	}
+	return events
+}
+
+func useRelayDestination(t *testing.T, config SSHConfig) {
+	t.Helper()
+	useDestinationsKey(t)
+	destinationsMutex.Lock()
+	destinations["box"] = Destination{Name: "box", SSHConfig: config}
+	destinationsMutex.Unlock()
+}
+
+func TestRelayEventsEndTheStream(t *testing.T) {
+	_, config := sftpTestConfig(t)
+	useRelayDestination(t, config)
+	server := newChunkedTestServer(t)
+
+	content := testContent(4 * int(MinChunkSize))
+	upload := postInit(t, server, fmt.Sprintf(`{"filename":"relayed.bin","totalSize":%d,"chunkSize":%d,"totalChunks":4,"destination":"box"}`,
+		len(content), MinChunkSize))
+
+	ready := make(chan struct{})
+	streamed := make(chan []progressEvent)
+	go func() { streamed <- readEvents(t, server, upload.ID, ready) }()
+	<-ready
+
+	uploadConcurrently(t, server, upload, content, 1)
+	events := <-streamed
+	checkRemote(t, config, "relayed.bin", content)
+
+	var names []string
+	for _, event := range events {
+		status, _ := event.Data["status"].(string)
+		names = append(names, event.Name+":"+status)
+	}
+	trace := strings.Join(names, " ")
+
+	// The stream outlives completed, reports the relay, and ends with it
+	completed := strings.Index(trace, "completed:completed")
+	relaying := strings.Index(trace, "relay:relaying")
+	progress := strings.Index(trace, "relay: ")
+	if completed < 0 || relaying < completed || progress < relaying || !strings.HasSuffix(trace, "relay:completed") {
+		t.Errorf("events %s, want completed, relay:relaying, relay progress and a final relay:completed", trace)
+	}
+	for _, event := range events {
+		if event.Name == string(StateCompleted) && event.Data["relay"] != string(RelayPending) {
+			t.Errorf("completed event says relay %v, want pending", event.Data["relay"])
+		}
+	}
+
+	// Once the relay is done a new subscriber gets the snapshot only
+	ready = make(chan struct{})
+	if events := readEvents(t, server, upload.ID, ready); len(events) != 1 || events[0].Name != "status" {
+		t.Errorf("late subscriber got %v, want one status snapshot", events)
+	}
+}
+
+func TestRelayFailureEndsTheStream(t *testing.T) {
+	_, config := sftpTestConfig(t)
+	config.Password = "wrong"
+	useRelayDestination(t, config)
+	server := newChunkedTestServer(t)
+
+	content := testContent(int(MinChunkSize))
+	upload := postInit(t, server, fmt.Sprintf(`{"filename":"lost.bin","totalSize":%d,"chunkSize":%d,"totalChunks":1,"destination":"box"}`,
+		len(content), MinChunkSize))
+
+	ready := make(chan struct{})
+	streamed := make(chan []progressEvent)
+	go func() { streamed <- readEvents(t, server, upload.ID, ready) }()
+	<-ready
+
+	uploadConcurrently(t, server, upload, content, 1)
+	events := <-streamed
+
+	last := events[len(events)-1]
+	if last.Name != "relay" || last.Data["status"] != string(RelayFailed) || last.Data["error"] == nil {
+		t.Errorf("last event %s %v, want a failed relay with its error", last.Name, last.Data)
+	}
+}
@@ -0,0 +1,121 @@
+package upload
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// Error codes returned in APIError.Code. They are part of the API: clients
+// branch on them, so existing codes must never change meaning.
+const (
+	CodeInvalidRequest       = "INVALID_REQUEST"        // Malformed body or query
+	CodeMethodNotAllowed     = "METHOD_NOT_ALLOWED"     // Wrong HTTP method for the endpoint
+	CodeUploadNotFound       = "UPLOAD_NOT_FOUND"       // No session with that ID
+	CodeUploadExpired        = "UPLOAD_EXPIRED"         // Session outlived SessionTTL
+	CodeUploadCancelled      = "UPLOAD_CANCELLED"       // Session was cancelled by the client
+	CodeUploadFailed         = "UPLOAD_FAILED"          // Session failed earlier, see details
+	CodeUploadNotReceiving   = "UPLOAD_NOT_RECEIVING"   // Session no longer accepts data
+	CodeWrongProtocol        = "WRONG_PROTOCOL"         // tus session used via the chunk API or vice versa
+	CodeFileExists           = "FILE_EXISTS"            // Final file exists and replace was not requested
+	CodeFileNotFound         = "FILE_NOT_FOUND"         // No stored file with that name
+	CodeInvalidFilename      = "INVALID_FILENAME"       // Filename rejected by sanitizeFilename
+	CodeInvalidChunkNumber   = "INVALID_CHUNK_NUMBER"   // chunkNum missing or not a number
+	CodeChunkOutOfRange      = "CHUNK_OUT_OF_RANGE"     // chunkNum outside 0..totalChunks-1
+	CodeChunkSizeMismatch    = "CHUNK_SIZE_MISMATCH"    // Chunk shorter than its slot
+	CodeChunkTooLarge        = "CHUNK_TOO_LARGE"        // Chunk longer than its slot
+	CodeChunkInProgress      = "CHUNK_IN_PROGRESS"      // Same chunk is being written by another request
+	CodeInvalidChunkLayout   = "INVALID_CHUNK_LAYOUT"   // totalSize, chunkSize and totalChunks disagree or break limits
+	CodeInvalidRange         = "INVALID_RANGE"          // Bad chunks window on the status endpoint
+	CodeInvalidMetadata      = "INVALID_METADATA"       // Metadata or tags break the rules in metadata.go
+	CodeFileTooLarge         = "FILE_TOO_LARGE"         // File exceeds MaxFileSize
+	CodeQuotaExceeded        = "QUOTA_EXCEEDED"         // Client exceeds ClientQuota
+	CodeInvalidChecksum      = "INVALID_CHECKSUM"       // Checksum is not a hex SHA-256 digest
+	CodeChecksumMismatch     = "CHECKSUM_MISMATCH"      // Data does not match its checksum
+	CodeContentRejected      = "CONTENT_REJECTED"       // Content policy refused the file
+	CodeUnsupportedMediaType = "UNSUPPORTED_MEDIA_TYPE" // Request Content-Type is wrong
+	CodeOffsetMismatch       = "OFFSET_MISMATCH"        // tus Upload-Offset differs from the server's
+	CodeUploadLocked         = "UPLOAD_LOCKED"          // Another tus PATCH is running
+	CodeTusVersion           = "TUS_VERSION_UNSUPPORTED"
+	CodeRateLimited          = "RATE_LIMITED" // Concurrency limit hit, see Retry-After
+	CodeSSHConfigInvalid     = "SSH_CONFIG_INVALID"
+	CodeSSHFailed            = "SSH_FAILED"            // Connecting or copying to the SSH host failed
+	CodeSSHHostKeyUnknown    = "SSH_HOST_KEY_UNKNOWN"  // Host key not in known_hosts and not pinned
+	CodeSSHHostKeyMismatch   = "SSH_HOST_KEY_MISMATCH" // Host presented a different key than the trusted one
+	CodeDestinationNotFound  = "DESTINATION_NOT_FOUND" // No SSH destination profile with that name
+	CodeDestinationExists    = "DESTINATION_EXISTS"    // SSH destination profile name is taken
+	CodeStreamingUnsupported = "STREAMING_UNSUPPORTED"
+	CodeInternal             = "INTERNAL_ERROR"
+)
+
+// APIError is the error half of the response envelope.
+type APIError struct {
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// envelope wraps every JSON body the API sends: data on success, error
+// otherwise, and the request ID either way so logs can be correlated.
+type envelope struct {
+	RequestID string      `json:"requestId"`
+	Data      interface{} `json:"data,omitempty"`
+	Error     *APIError   `json:"error,omitempty"`
+}
+
+// requestIDHeader carries the request ID in both directions. A client may
+// send its own; otherwise WithRequestID assigns one.
+const requestIDHeader = "X-Request-ID"
+
+// WithRequestID makes sure every request has an ID and echoes it in the
+// response headers, where writeJSON and writeError pick it up.
+func WithRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			b := make([]byte, 8)
+			rand.Read(b)
+			id = hex.EncodeToString(b)
+			r.Header.Set(requestIDHeader, id)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON sends data wrapped in the response envelope.
+func writeJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope{RequestID: w.Header().Get(requestIDHeader), Data: data})
+}
+
+// writeError sends an error wrapped in the response envelope.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorDetails(w, status, code, message, nil)
+}
+
+// writeErrorDetails is writeError with machine-readable details, e.g. the
+// limit that was hit.
+func writeErrorDetails(w http.ResponseWriter, status int, code, message string, details interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(envelope{
+		RequestID: w.Header().Get(requestIDHeader),
+		Error:     &APIError{Code: code, Message: message, Details: details},
+	})
+}
+
+// writeLimitError reports a violated limit with the limit's name as details.
+func writeLimitError(w http.ResponseWriter, err *LimitError) {
+	writeErrorDetails(w, err.Status, err.Code, err.Error(), map[string]interface{}{"limit": err.Limit})
+}
+
+// methodNotAllowed answers a request with the wrong HTTP method.
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, CodeMethodNotAllowed, fmt.Sprintf("Method not allowed; use %s", allowed))
+}
@@ -0,0 +1,60 @@
+package upload
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseChunkRange parses a chunks query like "10-99", "10-" or "7" into an
+// inclusive window of chunk numbers, clamped to the upload. An empty query
+// selects every chunk.
+func (upload *ChunkedUpload) parseChunkRange(query string) (first, last int, err error) {
+	first, last = 0, upload.TotalChunks-1
+	if query == "" {
+		return first, last, nil
+	}
+
+	start, end, isRange := strings.Cut(query, "-")
+	if first, err = strconv.Atoi(start); err != nil || first < 0 {
+		return 0, 0, fmt.Errorf("invalid chunks range %q: want first-last", query)
+	}
+	switch {
+	case !isRange:
+		last = first
+	case end != "":
+		if last, err = strconv.Atoi(end); err != nil || last < first {
+			return 0, 0, fmt.Errorf("invalid chunks range %q: want first-last", query)
+		}
+	}
+
+	if first > upload.TotalChunks-1 {
+		return 0, 0, fmt.Errorf("chunks range %q is outside 0..%d", query, upload.TotalChunks-1)
+	}
+	if last > upload.TotalChunks-1 {
+		last = upload.TotalChunks - 1
+	}
+	return first, last, nil
+}
+
+// missingRanges lists the chunks between first and last that have not been
+// received, merged into ranges like "3-5" or "8". Callers must hold
+// upload.mutex.
+func (upload *ChunkedUpload) missingRanges(first, last int) []string {
+	ranges := []string{}
+	for chunkNum := first; chunkNum <= last; chunkNum++ {
+		if upload.ReceivedChunks[chunkNum] {
+			continue
+		}
+		start := chunkNum
+		for chunkNum < last && !upload.ReceivedChunks[chunkNum+1] {
+			chunkNum++
+		}
+		if start == chunkNum {
+			ranges = append(ranges, strconv.Itoa(start))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("%d-%d", start, chunkNum))
+		}
+	}
+	return ranges
+}
@@ -0,0 +1,366 @@
+package upload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const manifestName = "manifest.json"
+
+// chunkLogName is the append-only list of chunks received since the manifest
+// was last written, one chunk number per line.
+const chunkLogName = "chunk.log"
+
+// uploadManifest is the on-disk record of a chunked upload session. It lives
+// next to the data file in uploads/temp/<id> so a restarted server can pick
+// the session back up.
+type uploadManifest struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	StorageKey  string `json:"storageKey,omitempty"`
+	TotalSize   int64  `json:"totalSize"`
+	Checksum    string `json:"checksum,omitempty"`
+	ChunkSize   int64  `json:"chunkSize"`
+	TotalChunks int    `json:"totalChunks"`
+
+	ConcurrentUploads int `json:"concurrentUploads,omitempty"`
+
+	// Chunks whose bytes are safely in the data file
+	ReceivedChunks []int `json:"receivedChunks,omitempty"`
+
+	Tus         bool      `json:"tus,omitempty"`
+	TusMetadata string    `json:"tusMetadata,omitempty"`
+	ExpiresAt   time.Time `json:"expiresAt"`
+
+	State       UploadState `json:"state"`
+	Error       string      `json:"error,omitempty"`
+	ClientID    string      `json:"clientId,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     []string          `json:"tags,omitempty"`
+
+	Relay *RelayStatus `json:"relay,omitempty"`
+}
+
+func tempDir(uploadID string) string {
+	return filepath.Join("uploads", "temp", uploadID)
+}
+
+// dataPath is the file an upload's bytes are written into: chunks at their
+// offsets, tus data appended.
+func dataPath(uploadID string) string {
+	return filepath.Join(tempDir(uploadID), "data")
+}
+
+// createDataFile creates an upload's data file with the given size. The
+// file is sparse, so unwritten chunks take no disk space.
+func createDataFile(uploadID string, size int64) error {
+	file, err := os.Create(dataPath(uploadID))
+	if err != nil {
+		return err
+	}
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// saveManifest writes the session manifest atomically so a crash never leaves
+// a half-written manifest behind.
+func saveManifest(upload *ChunkedUpload) error {
+	// A cancelled session has no directory left to save into
+	if upload.State == StateCancelled {
+		return nil
+	}
+
+	received := make([]int, 0, len(upload.ReceivedChunks))
+	for chunkNum := range upload.ReceivedChunks {
+		received = append(received, chunkNum)
+	}
+	sort.Ints(received)
+
+	data, err := json.MarshalIndent(uploadManifest{
+		ID:                upload.ID,
+		Filename:          upload.Filename,
+		StorageKey:        upload.StorageKey,
+		TotalSize:         upload.TotalSize,
+		Checksum:          upload.Checksum,
+		ChunkSize:         upload.ChunkSize,
+		TotalChunks:       upload.TotalChunks,
+		ReceivedChunks:    received,
+		ConcurrentUploads: upload.ConcurrentUploads,
+		Tus:               upload.Tus,
+		TusMetadata:       upload.TusMetadata,
+		ExpiresAt:         upload.ExpiresAt,
+		State:             upload.State,
+		Error:             upload.Error,
+		ClientID:          upload.ClientID,
+		ContentType:       upload.ContentType,
+		Metadata:          upload.Metadata,
+		Tags:              upload.Tags,
+		Relay:             upload.Relay,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(tempDir(upload.ID), manifestName)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// recordChunk appends chunkNum to the session's chunk log. Receiving a chunk
+// then costs one short write instead of rewriting the whole manifest, whose
+// list of received chunks grows with every chunk. Callers must hold
+// upload.mutex.
+func recordChunk(upload *ChunkedUpload, chunkNum int) error {
+	file, err := os.OpenFile(filepath.Join(tempDir(upload.ID), chunkLogName), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(file, "%d\n", chunkNum)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// loadChunkLog returns the chunks listed in the chunk log in dir and when the
+// last one was recorded. A line cut short by a crash is ignored.
+func loadChunkLog(dir string) ([]int, time.Time, error) {
+	path := filepath.Join(dir, chunkLogName)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, time.Time{}, nil
+		}
+		return nil, time.Time{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	chunks := make([]int, 0, len(lines))
+	// The last element is whatever followed the final newline
+	for _, line := range lines[:len(lines)-1] {
+		if chunkNum, err := strconv.Atoi(line); err == nil {
+			chunks = append(chunks, chunkNum)
+		}
+	}
+	return chunks, info.ModTime(), nil
+}
+
+// loadSession rebuilds a ChunkedUpload from the manifest in dir.
+func loadSession(dir string) (*ChunkedUpload, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	var m uploadManifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %v", err)
+	}
+	if m.ID != filepath.Base(dir) {
+		return nil, fmt.Errorf("manifest id %q does not match directory", m.ID)
+	}
+
+	upload := &ChunkedUpload{
+		ID:                m.ID,
+		Filename:          m.Filename,
+		StorageKey:        m.StorageKey,
+		ReceivedChunks:    make(map[int]bool),
+		TotalSize:         m.TotalSize,
+		Checksum:          m.Checksum,
+		ChunkSize:         m.ChunkSize,
+		TotalChunks:       m.TotalChunks,
+		ConcurrentUploads: m.ConcurrentUploads,
+		Tus:               m.Tus,
+		TusMetadata:       m.TusMetadata,
+		ExpiresAt:         m.ExpiresAt,
+		State:             m.State,
+		Error:             m.Error,
+		ClientID:          m.ClientID,
+		ContentType:       m.ContentType,
+		Metadata:          m.Metadata,
+		Tags:              m.Tags,
+		Relay:             m.Relay,
+	}
+	// Manifests written before states, expiry and concurrency were tracked
+	if upload.State == "" {
+		upload.State = StateReceiving
+	}
+	if upload.ExpiresAt.IsZero() {
+		upload.touch()
+	}
+	if upload.ConcurrentUploads == 0 && !upload.Tus {
+		upload.ConcurrentUploads = MaxSessionChunks
+	}
+
+	// The data of a completed upload is gone; everything was received
+	if upload.State == StateCompleted {
+		for i := 0; i < upload.TotalChunks; i++ {
+			upload.ReceivedChunks[i] = true
+		}
+		upload.UploadedSize = upload.TotalSize
+		return upload, nil
+	}
+
+	// tus uploads append to a single data file; its size is the offset
+	if upload.Tus {
+		info, err := os.Stat(dataPath(upload.ID))
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			upload.UploadedSize = info.Size()
+		}
+		return upload, nil
+	}
+
+	logged, lastChunk, err := loadChunkLog(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, chunkNum := range append(m.ReceivedChunks, logged...) {
+		if chunkNum >= 0 && chunkNum < upload.TotalChunks {
+			upload.ReceivedChunks[chunkNum] = true
+		}
+	}
+	// Chunks only in the log extended the session without saving its expiry
+	if expires := lastChunk.Add(SessionTTL); len(logged) > 0 && expires.After(upload.ExpiresAt) {
+		upload.ExpiresAt = expires
+	}
+	if err := migrateChunkFiles(upload); err != nil {
+		return nil, err
+	}
+	for chunkNum := range upload.ReceivedChunks {
+		upload.UploadedSize += upload.expectedChunkSize(chunkNum)
+	}
+
+	return upload, nil
+}
+
+// migrateChunkFiles moves chunk_N files written by the old one-file-per-chunk
+// layout into their slots in the data file, so sessions started before an
+// upgrade can still finish.
+func migrateChunkFiles(upload *ChunkedUpload) error {
+	dir := tempDir(upload.ID)
+
+	// Leftovers of the old layout that were never complete
+	partials, _ := filepath.Glob(filepath.Join(dir, "*.part"))
+	for _, partial := range append(partials, filepath.Join(dir, "merged")) {
+		os.Remove(partial)
+	}
+
+	chunkFiles, _ := filepath.Glob(filepath.Join(dir, "chunk_*"))
+	if _, err := os.Stat(dataPath(upload.ID)); os.IsNotExist(err) {
+		if err := createDataFile(upload.ID, upload.TotalSize); err != nil {
+			return err
+		}
+	}
+	if len(chunkFiles) == 0 {
+		return nil
+	}
+
+	dataFile, err := os.OpenFile(dataPath(upload.ID), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	for _, chunkFile := range chunkFiles {
+		chunkNum, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(chunkFile), "chunk_"))
+		if err != nil || chunkNum < 0 || chunkNum >= upload.TotalChunks {
+			continue
+		}
+
+		chunk, err := os.Open(chunkFile)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.NewOffsetWriter(dataFile, int64(chunkNum)*upload.ChunkSize), chunk)
+		chunk.Close()
+		if err != nil {
+			return fmt.Errorf("failed to migrate chunk %d: %v", chunkNum, err)
+		}
+		upload.ReceivedChunks[chunkNum] = true
+	}
+
+	// Record the migrated chunks before dropping their files; a crash in
+	// between just migrates them again
+	if err := dataFile.Sync(); err != nil {
+		return err
+	}
+	if err := saveManifest(upload); err != nil {
+		return err
+	}
+	for _, chunkFile := range chunkFiles {
+		os.Remove(chunkFile)
+	}
+	return nil
+}
+
+// LoadSessions restores every chunked upload session found under
+// uploads/temp. It is meant to be called once at startup, before the
+// server starts accepting requests.
+func LoadSessions() (int, error) {
+	entries, err := os.ReadDir(filepath.Join("uploads", "temp"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	loaded := 0
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		upload, err := loadSession(filepath.Join("uploads", "temp", entry.Name()))
+		if err != nil {
+			fmt.Printf("Skipping upload session %s: %v\n", entry.Name(), err)
+			continue
+		}
+
+		uploadsMutex.Lock()
+		activeUploads[upload.ID] = upload
+		uploadsMutex.Unlock()
+		loaded++
+
+		// A relay cut short by the restart starts again; UploadFileViaSSH
+		// overwrites whatever partial file it left behind
+		if upload.State == StateCompleted && upload.Relay != nil &&
+			(upload.Relay.State == RelayPending || upload.Relay.State == RelayRelaying) {
+			upload.queueRelay()
+		}
+
+		// All data made it to disk before the restart but assembly did not
+		// finish; run it again.
+		if upload.State == StateMerging || (upload.State == StateReceiving && upload.hasAllData()) {
+			upload.State = StateMerging
+			if upload.Tus {
+				go runTusFinish(upload)
+			} else {
+				go runMerge(upload)
+			}
+		}
+	}
+
+	return loaded, nil
+}
@@ -1,13 +1,18 @@
 package upload
 
 import (
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 
 	"encoding/json"
 	"io"
 	"net/http"
-	"path/filepath"
+	"path"
+	"strconv"
+	"time"
 
 	"github.com/pkg/sftp"
 	"golang.org/x/crypto/ssh"
@@ -21,13 +26,21 @@ type SSHConfig struct {
 	KeyFile    string `json:"keyFile,omitempty"`
 	RemoteDir  string `json:"remoteDir"`
 	AuthMethod string `json:"authMethod"`
+
+	// HostKeyFingerprint pins the server's key (SHA256:..., as returned by
+	// /api/v1/ssh/test). Without it the key must be in KnownHostsFile.
+	HostKeyFingerprint string `json:"hostKeyFingerprint,omitempty"`
 }
 
-func TestSSHConnection(config SSHConfig) error {
+// dialSSH connects and authenticates to the server in config. The key the
+// server presented is returned even if the connection failed, as long as the
+// handshake got that far.
+func dialSSH(config SSHConfig) (*ssh.Client, HostKey, error) {
+	var presented HostKey
 	sshConfig := &ssh.ClientConfig{
 		User:            config.Username,
 		Auth:            []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		HostKeyCallback: hostKeyCallback(config, &presented),
 	}
 
 	if config.AuthMethod == "password" {
@@ -36,12 +49,12 @@ func TestSSHConnection(config SSHConfig) error {
 		// Handle SSH key authentication
 		key, err := os.ReadFile(config.KeyFile)
 		if err != nil {
-			return fmt.Errorf("unable to read private key: %v", err)
+			return nil, presented, fmt.Errorf("unable to read private key: %v", err)
 		}
 
 		signer, err := ssh.ParsePrivateKey(key)
 		if err != nil {
-			return fmt.Errorf("unable to parse private key: %v", err)
+			return nil, presented, fmt.Errorf("unable to parse private key: %v", err)
 		}
 
 		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(signer))
@@ -49,177 +62,646 @@ func TestSSHConnection(config SSHConfig) error {
 
 	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", config.Host, config.Port), sshConfig)
 	if err != nil {
-		return fmt.Errorf("failed to connect: %v", err)
+		return nil, presented, fmt.Errorf("failed to connect: %w", err)
+	}
+	return client, presented, nil
+}
+
+// TestSSHConnection connects to the server in config and returns the host
+// key it presented.
+func TestSSHConnection(config SSHConfig) (HostKey, error) {
+	client, hostKey, err := dialSSH(config)
+	if err != nil {
+		return hostKey, err
 	}
 	defer client.Close()
 
-	return nil
+	return hostKey, nil
 }
 
-func UploadFileViaSSH(config SSHConfig, localFilePath string, originalFilename string) error {
-	// Setup SSH client configuration
-	sshConfig := &ssh.ClientConfig{
-		User:            config.Username,
-		Auth:            []ssh.AuthMethod{},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // Note: In production, use proper host key verification
+// SSHRetries is how many more times a failed relay is attempted. Retrying
+// needs the data again, so with retries the upload is staged on local disk
+// first; without them it is streamed straight through.
+var SSHRetries = 0
+
+// SSHRetryDelay is the pause before the first retry. It doubles for every
+// further retry, up to SSHMaxRetryDelay.
+var SSHRetryDelay = 2 * time.Second
+
+// SSHMaxRetryDelay caps the pause between relay attempts.
+var SSHMaxRetryDelay = time.Minute
+
+// SSHResumeHash makes a retry compare the SHA-256 of the data already on the
+// remote host with the local file before continuing after it. It needs
+// head and sha256sum on the remote host; without them only the size is
+// checked.
+var SSHResumeHash = true
+
+// maxSSHFieldSize bounds the non-file form fields of an SSH upload.
+const maxSSHFieldSize = 64 << 10
+
+// partSuffix marks a remote file that is still being written. It is renamed
+// to the final name once complete, so nothing on the remote host sees a
+// partial file under the real name.
+const partSuffix = ".part"
+
+// UploadFileViaSSH copies the local file to config.RemoteDir over SFTP.
+// onProgress, if not nil, is called with the bytes written so far after every
+// block. A failed attempt is retried up to SSHRetries times with
+// exponential backoff, continuing after the data the remote host already
+// has instead of starting over.
+func UploadFileViaSSH(config SSHConfig, localFilePath string, originalFilename string, onProgress func(written, total int64)) error {
+	// The name ends up in a remote path; never let it climb out of RemoteDir
+	filename, err := sanitizeFilename(originalFilename)
+	if err != nil {
+		return err
 	}
 
-	// Set up authentication
-	if config.AuthMethod == "password" {
-		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(config.Password))
-	} else {
-		key, err := os.ReadFile(config.KeyFile)
-		if err != nil {
-			return fmt.Errorf("unable to read private key: %v", err)
-		}
+	// Open local file
+	localFile, err := os.Open(localFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to open local file: %v", err)
+	}
+	defer localFile.Close()
 
-		signer, err := ssh.ParsePrivateKey(key)
-		if err != nil {
-			return fmt.Errorf("unable to parse private key: %v", err)
+	// Get file info for size
+	fileInfo, err := localFile.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to get file info: %v", err)
+	}
+
+	remoteFilePath := path.Join(config.RemoteDir, filename)
+	delay := SSHRetryDelay
+	var hostKeyErr *HostKeyError
+	for attempt := 0; ; attempt++ {
+		// Only resume a partial file an earlier attempt of this relay wrote;
+		// anything older may belong to a different file of the same name
+		err = transferFile(config, localFile, fileInfo.Size(), remoteFilePath, attempt > 0, onProgress)
+
+		if err == nil || attempt >= SSHRetries || errors.As(err, &hostKeyErr) {
+			break
 		}
-		sshConfig.Auth = append(sshConfig.Auth, ssh.PublicKeys(signer))
+		fmt.Printf("\nSSH upload of %s failed (attempt %d of %d): %v; retrying in %s\n", filename, attempt+1, SSHRetries+1, err, delay)
+		time.Sleep(delay)
+		if delay *= 2; delay > SSHMaxRetryDelay {
+			delay = SSHMaxRetryDelay
+		}
+	}
+
+	// Out of retries; do not leave the partial file on the host. A host
+	// whose key was refused never got one, and is not connected to again
+	if err != nil && !errors.As(err, &hostKeyErr) {
+		removeRemoteFile(config, remoteFilePath+partSuffix)
+	}
+	return err
+}
+
+// transferFile makes one attempt at copying localFile to remoteFilePath. If
+// resume is set it continues after the data already in the remote partial
+// file, once that has been verified.
+func transferFile(config SSHConfig, localFile *os.File, size int64, remoteFilePath string, resume bool, onProgress func(written, total int64)) error {
+	session, err := openSFTP(config)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	offset := int64(0)
+	if resume {
+		offset = resumeOffset(session.client, session.sftp, localFile, remoteFilePath+partSuffix, size)
+	}
+	if _, err := localFile.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek local file: %v", err)
 	}
 
+	_, err = session.writeRemoteFile(localFile, offset, size, remoteFilePath, onProgress)
+	return err
+}
+
+// sftpSession is an SSH connection with an SFTP client on top of it.
+type sftpSession struct {
+	client *ssh.Client
+	sftp   *sftp.Client
+}
+
+// openSFTP connects to the server in config and makes sure config.RemoteDir
+// exists there.
+func openSFTP(config SSHConfig) (*sftpSession, error) {
 	// Connect to SSH server
-	client, err := ssh.Dial("tcp", fmt.Sprintf("%s:%s", config.Host, config.Port), sshConfig)
+	client, _, err := dialSSH(config)
 	if err != nil {
-		return fmt.Errorf("failed to connect to SSH server: %v", err)
+		return nil, err
 	}
-	defer client.Close()
 
 	// Create new SFTP client
 	sftpClient, err := sftp.NewClient(client)
 	if err != nil {
-		return fmt.Errorf("failed to create SFTP client: %v", err)
+		client.Close()
+		return nil, fmt.Errorf("failed to create SFTP client: %v", err)
 	}
-	defer sftpClient.Close()
 
-	// Open local file
-	localFile, err := os.Open(localFilePath)
+	// Create remote directory if it doesn't exist
+	if err := sftpClient.MkdirAll(config.RemoteDir); err != nil {
+		sftpClient.Close()
+		client.Close()
+		return nil, fmt.Errorf("failed to create remote directory: %v", err)
+	}
+	return &sftpSession{client: client, sftp: sftpClient}, nil
+}
+
+func (session *sftpSession) Close() {
+	session.sftp.Close()
+	session.client.Close()
+}
+
+// writeRemoteFile copies src into the partial file of remoteFilePath, which
+// already holds the offset bytes before src, then renames it into place once
+// it is exactly as long as what was sent (and as size, if not -1). It
+// returns the partial file's length. A partial file of the wrong length is
+// removed; after any other failure it is left for a retry to resume.
+func (session *sftpSession) writeRemoteFile(src io.Reader, offset, size int64, remoteFilePath string, onProgress func(written, total int64)) (int64, error) {
+	partPath := remoteFilePath + partSuffix
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	remoteFile, err := session.sftp.OpenFile(partPath, flags)
 	if err != nil {
-		return fmt.Errorf("failed to open local file: %v", err)
+		return 0, fmt.Errorf("failed to create remote file: %v", err)
+	}
+	if _, err := remoteFile.Seek(offset, io.SeekStart); err != nil {
+		remoteFile.Close()
+		return 0, fmt.Errorf("failed to seek remote file: %v", err)
 	}
-	defer localFile.Close()
 
-	// Get file info for size
-	fileInfo, err := localFile.Stat()
+	written, err := copyToRemote(remoteFile, src, offset, size, onProgress)
+	if closeErr := remoteFile.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("error closing remote file: %v", closeErr)
+	}
 	if err != nil {
-		return fmt.Errorf("failed to get file info: %v", err)
+		return written, err
+	}
+	if err := verifyRemoteSize(session.sftp, partPath, written, size); err != nil {
+		// Whatever is there is wrong; the next attempt starts over
+		session.sftp.Remove(partPath)
+		return written, err
 	}
+	return written, commitRemoteFile(session.sftp, partPath, remoteFilePath)
+}
 
-	// Create remote directory if it doesn't exist
-	err = sftpClient.MkdirAll(config.RemoteDir)
+// resumeOffset returns how much of the remote partial file can be kept: its
+// size, if it is no longer than the local file and, with SSHResumeHash, its
+// SHA-256 matches the same prefix of the local file. 0 means start over.
+func resumeOffset(client *ssh.Client, sftpClient *sftp.Client, localFile *os.File, partPath string, size int64) int64 {
+	info, err := sftpClient.Stat(partPath)
+	if err != nil || info.Size() == 0 || info.Size() > size {
+		return 0
+	}
+	offset := info.Size()
+
+	if SSHResumeHash {
+		remoteSum, err := remotePrefixHash(client, partPath, offset)
+		if err != nil {
+			fmt.Printf("Cannot hash %s on the remote host (%v); resuming on size alone\n", partPath, err)
+		} else {
+			hasher := newHash()
+			if _, err := io.Copy(hasher, io.NewSectionReader(localFile, 0, offset)); err != nil {
+				return 0
+			}
+			if hex.EncodeToString(hasher.Sum(nil)) != remoteSum {
+				fmt.Printf("Remote data in %s does not match the local file; starting over\n", partPath)
+				return 0
+			}
+		}
+	}
+
+	fmt.Printf("Resuming upload of %s at byte %d of %d\n", partPath, offset, size)
+	return offset
+}
+
+// remotePrefixHash runs sha256sum over the first n bytes of remotePath on
+// the remote host.
+func remotePrefixHash(client *ssh.Client, remotePath string, n int64) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+
+	output, err := session.Output(fmt.Sprintf("head -c %d %s | sha256sum", n, shellQuote(remotePath)))
 	if err != nil {
-		return fmt.Errorf("failed to create remote directory: %v", err)
+		return "", err
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 || len(fields[0]) != 64 {
+		return "", fmt.Errorf("unexpected sha256sum output %q", output)
+	}
+	return fields[0], nil
+}
+
+// shellQuote quotes s for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// commitRemoteFile moves a completed partial file to its final name,
+// replacing any file already there.
+func commitRemoteFile(sftpClient *sftp.Client, partPath, remoteFilePath string) error {
+	if _, ok := sftpClient.HasExtension("posix-rename@openssh.com"); ok {
+		if err := sftpClient.PosixRename(partPath, remoteFilePath); err != nil {
+			return fmt.Errorf("failed to rename remote file: %v", err)
+		}
+		return nil
+	}
+
+	// Plain SFTP rename refuses to overwrite
+	sftpClient.Remove(remoteFilePath)
+	if err := sftpClient.Rename(partPath, remoteFilePath); err != nil {
+		return fmt.Errorf("failed to rename remote file: %v", err)
 	}
+	return nil
+}
 
-	// Create remote file
-	remoteFilePath := filepath.Join(config.RemoteDir, originalFilename)
-	remoteFile, err := sftpClient.Create(remoteFilePath)
+// removeRemoteFile deletes a remote file on a connection of its own, for
+// cleaning up after a failed transfer. Errors are ignored; the host may be
+// the reason the transfer failed.
+func removeRemoteFile(config SSHConfig, remotePath string) {
+	client, _, err := dialSSH(config)
 	if err != nil {
-		return fmt.Errorf("failed to create remote file: %v", err)
+		return
 	}
-	defer remoteFile.Close()
+	defer client.Close()
 
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return
+	}
+	defer sftpClient.Close()
+	sftpClient.Remove(remotePath)
+}
+
+// sendViaSSH streams src into config.RemoteDir over SFTP and returns the
+// number of bytes sent. size is the expected length, or -1 if unknown. Once
+// the copy finishes the remote file must be exactly as long as what was
+// sent (and as size, if known); otherwise, or if the copy fails, the remote
+// file is removed again. A stream cannot be rewound, so there is no retry.
+func sendViaSSH(config SSHConfig, src io.Reader, size int64, originalFilename string, onProgress func(written, total int64)) (int64, error) {
+	// The name ends up in a remote path; never let it climb out of RemoteDir
+	filename, err := sanitizeFilename(originalFilename)
+	if err != nil {
+		return 0, err
+	}
+
+	session, err := openSFTP(config)
+	if err != nil {
+		return 0, err
+	}
+	defer session.Close()
+
+	remoteFilePath := path.Join(config.RemoteDir, filename)
+	written, err := session.writeRemoteFile(src, 0, size, remoteFilePath, onProgress)
+	if err != nil {
+		session.sftp.Remove(remoteFilePath + partSuffix)
+	}
+	return written, err
+}
+
+// copyToRemote copies src to the remote file, which already holds offset
+// bytes, reporting progress after every block. It returns the remote
+// file's length. Read errors are wrapped so callers can tell a client that
+// went away or sent too much from a failing remote end.
+func copyToRemote(remoteFile io.Writer, src io.Reader, offset, size int64, onProgress func(written, total int64)) (int64, error) {
 	// Create a buffer for copying
 	buf := make([]byte, 32*1024) // 32KB buffer
-	totalWritten := int64(0)
+	totalWritten := offset
 
 	// Copy file with progress tracking
 	for {
-		n, err := localFile.Read(buf)
-		if err != nil && err != io.EOF {
-			return fmt.Errorf("error reading local file: %v", err)
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := remoteFile.Write(buf[:n]); err != nil {
+				return totalWritten, fmt.Errorf("error writing to remote file: %v", err)
+			}
+
+			totalWritten += int64(n)
+			if size > 0 {
+				progress := float64(totalWritten) / float64(size) * 100
+				fmt.Printf("\rUploading... %.2f%%", progress)
+			}
+			if onProgress != nil {
+				onProgress(totalWritten, size)
+			}
 		}
-		if n == 0 {
-			break
+		if err == io.EOF {
+			return totalWritten, nil
 		}
-
-		_, err = remoteFile.Write(buf[:n])
 		if err != nil {
-			return fmt.Errorf("error writing to remote file: %v", err)
+			return totalWritten, fmt.Errorf("error reading upload: %w", err)
 		}
+	}
+}
 
-		totalWritten += int64(n)
-		progress := float64(totalWritten) / float64(fileInfo.Size()) * 100
-		fmt.Printf("\rUploading... %.2f%%", progress)
+// verifyRemoteSize checks that the remote file holds exactly what was sent.
+func verifyRemoteSize(sftpClient *sftp.Client, remoteFilePath string, written, size int64) error {
+	if size >= 0 && written != size {
+		return invalid(CodeInvalidRequest, "size", "file size mismatch: declared %d bytes, received %d", size, written)
 	}
 
-	// Verify file size
 	remoteFileInfo, err := sftpClient.Stat(remoteFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to get remote file info: %v", err)
 	}
-
-	if remoteFileInfo.Size() != fileInfo.Size() {
-		return fmt.Errorf("file size mismatch: local %d != remote %d", fileInfo.Size(), remoteFileInfo.Size())
+	if remoteFileInfo.Size() != written {
+		return fmt.Errorf("file size mismatch: local %d != remote %d", written, remoteFileInfo.Size())
 	}
-
 	return nil
 }
 
-// Add a handler function for the HTTP endpoint
+// HandleSSHUpload relays a multipart upload to an SSH host. The multipart
+// body is read part by part: if destination (or sshConfig) comes before the
+// file, the file is streamed straight to the remote host while it arrives.
+// A file sent before its destination, or any file when SSHRetries is set,
+// is staged on local disk first.
 func HandleSSHUpload(w http.ResponseWriter, r *http.Request) {
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		http.Error(w, "Error getting file: "+err.Error(), http.StatusBadRequest)
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
 		return
 	}
-	defer file.Close()
 
-	// Save original filename
-	originalFilename := header.Filename
+	// Refuse bodies that cannot fit within MaxFileSize
+	if MaxFileSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxFileSize+multipartOverhead)
+	}
 
-	// Create a temporary file
-	tempFile, err := os.CreateTemp("", "ssh-upload-*")
+	reader, err := r.MultipartReader()
 	if err != nil {
-		http.Error(w, "Error creating temp file: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing form: "+err.Error())
 		return
 	}
-	defer os.Remove(tempFile.Name())
-	defer tempFile.Close()
 
-	// Copy uploaded file to temp file
-	_, err = io.Copy(tempFile, file)
-	if err != nil {
-		http.Error(w, "Error saving temp file: "+err.Error(), http.StatusInternalServerError)
+	fields := make(map[string]string)
+	var config SSHConfig
+	var originalFilename, stagedPath string
+	var progressID string
+	var size int64 = -1
+	streamed, ok := false, false
+
+	// The file only passes through, but counts against the client's quota
+	// while it does
+	quota := &quotaReservation{client: clientID(r)}
+	defer quota.release()
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeBodyError(w, "Error parsing form: ", err)
+			return
+		}
+
+		if part.FormName() != "file" {
+			value, err := io.ReadAll(io.LimitReader(part, maxSSHFieldSize+1))
+			if err != nil {
+				writeBodyError(w, "Error parsing form: ", err)
+				return
+			}
+			if len(value) > maxSSHFieldSize {
+				writeError(w, http.StatusBadRequest, CodeInvalidRequest, fmt.Sprintf("form field %s exceeds %d bytes", part.FormName(), maxSSHFieldSize))
+				return
+			}
+			fields[part.FormName()] = string(value)
+			continue
+		}
+
+		if originalFilename != "" {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Only one file per request")
+			return
+		}
+
+		// Save original filename
+		originalFilename, err = sanitizeFilename(part.FileName())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeInvalidFilename, err.Error())
+			return
+		}
+
+		sniffed, body, err := sniff(part)
+		if err != nil {
+			writeBodyError(w, "Error reading file: ", err)
+			return
+		}
+		if err := Policies["ssh"].Check(originalFilename, part.Header.Get("Content-Type"), sniffed); err != nil {
+			writeError(w, http.StatusUnsupportedMediaType, CodeContentRejected, err.Error())
+			return
+		}
+		body = quota.reader(body)
+
+		// Stage the file if it has to be read more than once, or if there is
+		// nowhere to send it yet
+		if SSHRetries > 0 || !hasSSHDestination(fields) {
+			if stagedPath, err = stageSSHUpload(body); err != nil {
+				writeBodyError(w, "Error saving temp file: ", err)
+				return
+			}
+			defer os.Remove(stagedPath)
+			continue
+		}
+
+		if config, size, progressID, ok = sshUploadTarget(w, fields); !ok {
+			return
+		}
+		if size, err = sendViaSSH(config, body, size, originalFilename, relayProgress(progressID)); err != nil {
+			failSSHUpload(w, progressID, err)
+			return
+		}
+		streamed = true
+	}
+
+	if originalFilename == "" {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Error getting file: no file field in the form")
 		return
 	}
 
-	// Get SSH config from request
+	if !streamed {
+		if config, size, progressID, ok = sshUploadTarget(w, fields); !ok {
+			return
+		}
+		info, err := os.Stat(stagedPath)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error reading temp file: "+err.Error())
+			return
+		}
+		if size >= 0 && info.Size() != size {
+			writeLimitError(w, invalid(CodeInvalidRequest, "size", "file size mismatch: declared %d bytes, received %d", size, info.Size()))
+			return
+		}
+		size = info.Size()
+
+		if err := UploadFileViaSSH(config, stagedPath, originalFilename, relayProgress(progressID)); err != nil {
+			failSSHUpload(w, progressID, err)
+			return
+		}
+	}
+
+	if progressID != "" {
+		publishProgress(progressID, string(StateCompleted), map[string]interface{}{"status": StateCompleted})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"filename":   originalFilename,
+		"size":       size,
+		"remotePath": path.Join(config.RemoteDir, originalFilename),
+		"message":    fmt.Sprintf("File %s uploaded successfully via SSH", originalFilename),
+	})
+}
+
+// hasSSHDestination reports whether the form fields read so far say where to
+// send the file.
+func hasSSHDestination(fields map[string]string) bool {
+	return fields["destination"] != "" || fields["sshConfig"] != ""
+}
+
+// sshUploadTarget reads the SSH config, the optional declared size and the
+// progressId from the form fields. It answers the request itself and
+// returns false if they are invalid.
+func sshUploadTarget(w http.ResponseWriter, fields map[string]string) (SSHConfig, int64, string, bool) {
+	// Get SSH config from the named destination, or inline from the request
 	var config SSHConfig
-	configStr := r.FormValue("sshConfig")
-	if err := json.Unmarshal([]byte(configStr), &config); err != nil {
-		http.Error(w, "Error parsing SSH config: "+err.Error(), http.StatusBadRequest)
-		return
+	if name := fields["destination"]; name != "" {
+		var exists bool
+		if config, exists = lookupDestination(name); !exists {
+			writeErrorDetails(w, http.StatusNotFound, CodeDestinationNotFound, "Destination not found", map[string]interface{}{"name": name})
+			return config, 0, "", false
+		}
+	} else if err := json.Unmarshal([]byte(fields["sshConfig"]), &config); err != nil {
+		writeError(w, http.StatusBadRequest, CodeSSHConfigInvalid, "Error parsing SSH config: "+err.Error())
+		return config, 0, "", false
 	}
 
-	// Upload file via SSH
-	err = UploadFileViaSSH(config, tempFile.Name(), originalFilename)
+	// A declared size gives progress a total and is checked against what
+	// arrives
+	size := int64(-1)
+	if value := fields["size"]; value != "" {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n < 0 {
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "size must be a number of bytes")
+			return config, 0, "", false
+		}
+		var limitErr *LimitError
+		if err := checkFileSize(n); errors.As(err, &limitErr) {
+			writeLimitError(w, limitErr)
+			return config, 0, "", false
+		}
+		size = n
+	}
+
+	// Clients that want relay progress subscribe to
+	// /api/v1/upload/events?uploadId=<progressId> before uploading
+	return config, size, fields["progressId"], true
+}
+
+// stageSSHUpload copies an upload into a temporary file and returns its path.
+func stageSSHUpload(body io.Reader) (string, error) {
+	tempFile, err := os.CreateTemp("", "ssh-upload-*")
 	if err != nil {
-		http.Error(w, "Error uploading via SSH: "+err.Error(), http.StatusInternalServerError)
+		return "", err
+	}
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, body); err != nil {
+		os.Remove(tempFile.Name())
+		return "", err
+	}
+	return tempFile.Name(), nil
+}
+
+// failSSHUpload reports a failed relay to the client and to progress
+// subscribers.
+func failSSHUpload(w http.ResponseWriter, progressID string, err error) {
+	if progressID != "" {
+		publishProgress(progressID, string(StateFailed), map[string]interface{}{"status": StateFailed, "error": err.Error()})
+	}
+
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeBodyError(w, "", err)
 		return
 	}
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+	writeSSHError(w, "Error uploading via SSH: ", err)
+}
 
-	w.Write([]byte(fmt.Sprintf("File %s uploaded successfully via SSH", originalFilename)))
+// writeBodyError reports a failure to read the request body, which is a
+// 413 if the body outgrew MaxFileSize or the client's quota.
+func writeBodyError(w http.ResponseWriter, prefix string, err error) {
+	var limitErr *LimitError
+	if errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeLimitError(w, tooLarge(CodeFileTooLarge, "maxFileSize", "request body exceeds the limit of %d bytes", MaxFileSize))
+		return
+	}
+	writeError(w, http.StatusBadRequest, CodeInvalidRequest, prefix+err.Error())
 }
 
 func HandleSSHTest(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, http.MethodPost)
 		return
 	}
 
+	// ?destination=name tests a saved profile; otherwise the body is the config
 	var config SSHConfig
-	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+	if name := r.URL.Query().Get("destination"); name != "" {
+		var exists bool
+		if config, exists = lookupDestination(name); !exists {
+			writeErrorDetails(w, http.StatusNotFound, CodeDestinationNotFound, "Destination not found", map[string]interface{}{"name": name})
+			return
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid request body")
+		return
+	}
+
+	hostKey, err := TestSSHConnection(config)
+	if err != nil {
+		writeSSHError(w, "", err)
 		return
 	}
 
-	if err := TestSSHConnection(config); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"message":     "SSH connection successful",
+		"keyType":     hostKey.Type,
+		"fingerprint": hostKey.Fingerprint,
+	})
+}
+
+// writeSSHError reports a failed SSH operation. An untrusted host key gets
+// its own code and the presented fingerprint, so an operator can check it
+// and pin it with hostKeyFingerprint.
+func writeSSHError(w http.ResponseWriter, prefix string, err error) {
+	var hostKeyErr *HostKeyError
+	if !errors.As(err, &hostKeyErr) {
+		writeError(w, http.StatusInternalServerError, CodeSSHFailed, prefix+err.Error())
 		return
 	}
 
-	w.Write([]byte("SSH connection successful"))
+	code := CodeSSHHostKeyUnknown
+	if hostKeyErr.Mismatch {
+		code = CodeSSHHostKeyMismatch
+	}
+	writeErrorDetails(w, http.StatusBadGateway, code, prefix+hostKeyErr.Error(), map[string]interface{}{
+		"host":        hostKeyErr.Host,
+		"keyType":     hostKeyErr.Key.Type,
+		"fingerprint": hostKeyErr.Key.Fingerprint,
+	})
 }
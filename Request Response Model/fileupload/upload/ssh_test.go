@@ -0,0 +1,150 @@
+package upload
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// sftpTestConfig starts an SSH test server and returns a config that trusts
+// it and uploads into a fresh directory.
+func sftpTestConfig(t *testing.T) (*sshTestServer, SSHConfig) {
+	t.Helper()
+	server := startSSHTestServer(t)
+	useKnownHosts(t, HostKeyStrict)
+
+	config := server.config()
+	config.HostKeyFingerprint = server.fingerprint()
+	config.RemoteDir = t.TempDir()
+	return server, config
+}
+
+func useSSHRetries(t *testing.T, retries int) {
+	t.Helper()
+	previousRetries, previousDelay := SSHRetries, SSHRetryDelay
+	SSHRetries, SSHRetryDelay = retries, time.Millisecond
+	t.Cleanup(func() { SSHRetries, SSHRetryDelay = previousRetries, previousDelay })
+}
+
+func writeLocalFile(t *testing.T, content []byte) string {
+	t.Helper()
+	localPath := filepath.Join(t.TempDir(), "local")
+	if err := os.WriteFile(localPath, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return localPath
+}
+
+// checkRemote checks that the remote directory holds exactly name with
+// content, or nothing if content is nil.
+func checkRemote(t *testing.T, config SSHConfig, name string, content []byte) {
+	t.Helper()
+
+	entries, err := os.ReadDir(config.RemoteDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	if content == nil {
+		if len(names) != 0 {
+			t.Errorf("remote directory holds %v, want nothing", names)
+		}
+		return
+	}
+	if len(names) != 1 || names[0] != name {
+		t.Fatalf("remote directory holds %v, want [%s]", names, name)
+	}
+	remote, err := os.ReadFile(filepath.Join(config.RemoteDir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(remote, content) {
+		t.Errorf("remote file differs from the local one (%d bytes, want %d)", len(remote), len(content))
+	}
+}
+
+func TestSSHUploadResumesAfterDroppedConnection(t *testing.T) {
+	server, config := sftpTestConfig(t)
+	useSSHRetries(t, 1)
+
+	content := testContent(1 << 20)
+	server.dropConnections(1, int64(len(content))/2)
+	if err := UploadFileViaSSH(config, writeLocalFile(t, content), "resumed.bin", nil); err != nil {
+		t.Fatal(err)
+	}
+	checkRemote(t, config, "resumed.bin", content)
+
+	// Starting over would have sent about one and a half times the file
+	if received := server.received.Load(); received > int64(len(content))*5/4 {
+		t.Errorf("server received %d bytes for a %d byte file; the retry did not resume", received, len(content))
+	}
+}
+
+func TestSSHResumeChecksRemotePrefix(t *testing.T) {
+	content := testContent(256 << 10)
+	half := len(content) / 2
+
+	tests := []struct {
+		name    string
+		part    []byte
+		resumed bool
+	}{
+		{"matching prefix", content[:half], true},
+		{"different prefix", bytes.Repeat([]byte{'z'}, half), false},
+		{"longer than the file", append(append([]byte{}, content...), 'z'), false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, config := sftpTestConfig(t)
+			remotePath := filepath.Join(config.RemoteDir, "f.bin")
+			if err := os.WriteFile(remotePath+partSuffix, test.part, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			localFile, err := os.Open(writeLocalFile(t, content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer localFile.Close()
+
+			// The first progress report shows where the copy started
+			first := int64(-1)
+			err = transferFile(config, localFile, int64(len(content)), remotePath, true, func(written, total int64) {
+				if first < 0 {
+					first = written
+				}
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRemote(t, config, "f.bin", content)
+
+			if resumed := first > int64(half); resumed != test.resumed {
+				t.Errorf("first progress report at byte %d; resumed = %v, want %v", first, resumed, test.resumed)
+			}
+		})
+	}
+}
+
+func TestSSHUploadRemovesPartAfterFinalFailure(t *testing.T) {
+	for _, retries := range []int{0, 1} {
+		t.Run(fmt.Sprintf("%d retries", retries), func(t *testing.T) {
+			server, config := sftpTestConfig(t)
+			useSSHRetries(t, retries)
+
+			content := testContent(1 << 20)
+			server.dropConnections(retries+1, int64(len(content))/2)
+			if err := UploadFileViaSSH(config, writeLocalFile(t, content), "failed.bin", nil); err == nil {
+				t.Fatal("upload succeeded although every attempt was cut off")
+			}
+			checkRemote(t, config, "failed.bin", nil)
+		})
+	}
+}
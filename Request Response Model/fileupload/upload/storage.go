@@ -0,0 +1,260 @@
+package upload
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// FileInfo describes a finished file held by a Storage backend.
+type FileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// Storage is where finished uploads land. Names are flat file names, the
+// same ones clients send as the upload's filename. Stat, Open and Delete
+// return an error satisfying os.IsNotExist when the file does not exist.
+type Storage interface {
+	Put(name string, r io.Reader, size int64) error
+	Stat(name string) (FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Delete(name string) error
+	List() ([]FileInfo, error)
+}
+
+// fileMover is implemented by backends that can take ownership of a local
+// file more cheaply than copying it, e.g. with a rename.
+type fileMover interface {
+	MoveFile(name, localPath string) error
+}
+
+// rangeOpener is implemented by backends whose Open does not return an
+// io.Seeker but that can start reading part way into a file.
+type rangeOpener interface {
+	OpenRange(name string, offset int64) (io.ReadCloser, error)
+}
+
+// FinalStorage receives every completed upload. main swaps it out based on
+// configuration; it defaults to uploads/final on local disk.
+var FinalStorage Storage = NewLocalStorage(filepath.Join("uploads", "final"), filepath.Join("uploads", "staging"))
+
+// storeFile hands a fully assembled local file to FinalStorage. The local
+// file is gone afterwards either way. A cancelled ctx stops the copy.
+func storeFile(ctx context.Context, name, localPath string) error {
+	if err := ctx.Err(); err != nil {
+		return context.Cause(ctx)
+	}
+	if mover, ok := FinalStorage.(fileMover); ok {
+		return mover.MoveFile(name, localPath)
+	}
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(localPath)
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	return FinalStorage.Put(name, contextReader{ctx, file}, info.Size())
+}
+
+// RemovePartialUploads clears out files that a crash left half written in
+// FinalStorage's staging area. Backends without one have nothing to do.
+func RemovePartialUploads() (int, error) {
+	if local, ok := FinalStorage.(*LocalStorage); ok {
+		return local.RemovePartials()
+	}
+	return 0, nil
+}
+
+// LocalStorage keeps files in a directory on local disk. Files are written
+// into StagingDir first, fsynced and then renamed into Dir, so anything
+// watching Dir only ever sees complete files. StagingDir must be on the same
+// filesystem as Dir.
+type LocalStorage struct {
+	Dir        string
+	StagingDir string
+}
+
+func NewLocalStorage(dir, stagingDir string) *LocalStorage {
+	return &LocalStorage{Dir: dir, StagingDir: stagingDir}
+}
+
+// path maps a storage name to its file, refusing anything that would land
+// outside Dir.
+func (s *LocalStorage) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || name != filepath.Base(name) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidFilename, name)
+	}
+	return filepath.Join(s.Dir, name), nil
+}
+
+func (s *LocalStorage) Put(name string, r io.Reader, size int64) error {
+	if err := os.MkdirAll(s.StagingDir, 0755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(s.StagingDir, "put-*.partial")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) // No-op once renamed
+	defer tmp.Close()
+
+	written, err := io.Copy(tmp, r)
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("size mismatch: expected %d bytes, wrote %d", size, written)
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return s.rename(tmp.Name(), name)
+}
+
+// MoveFile fsyncs localPath and renames it into the storage directory.
+// localPath must be on the same filesystem.
+func (s *LocalStorage) MoveFile(name, localPath string) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	file.Close()
+	if err != nil {
+		return err
+	}
+
+	return s.rename(localPath, name)
+}
+
+// storedFileMode is the permission stored files get, whatever the temporary
+// file they were written to had; os.CreateTemp makes them 0600.
+const storedFileMode = 0644
+
+// rename atomically moves a synced file into place and fsyncs the directory
+// so the new entry survives a crash.
+func (s *LocalStorage) rename(src, name string) error {
+	dst, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	if err := os.Chmod(src, storedFileMode); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	return syncDir(s.Dir)
+}
+
+// RemovePartials deletes staging files left behind by writes that never
+// finished, e.g. because the server crashed. Call it at startup.
+func (s *LocalStorage) RemovePartials() (int, error) {
+	entries, err := os.ReadDir(s.StagingDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(s.StagingDir, entry.Name())); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (s *LocalStorage) Stat(name string) (FileInfo, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() {
+		return FileInfo{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return FileInfo{Name: name, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+// LocalPath returns the file holding name, for reading it in place.
+func (s *LocalStorage) LocalPath(name string) (string, error) {
+	return s.path(name)
+}
+
+func (s *LocalStorage) Open(name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(path)
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func (s *LocalStorage) List() ([]FileInfo, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, FileInfo{Name: entry.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
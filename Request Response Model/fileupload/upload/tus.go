@@ -0,0 +1,386 @@
+package upload
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tus 1.0 resumable upload protocol, see https://tus.io/protocols/resumable-upload
+//
+// Supported extensions: creation, termination and expiration. A tus upload
+// is a regular ChunkedUpload session whose bytes are appended to its
+// uploads/temp/<id>/data file instead of being written at chunk offsets.
+
+const (
+	TusBasePath  = "/api/v1/upload/tus/"
+	tusVersion   = "1.0.0"
+	tusExtension = "creation,termination,expiration"
+)
+
+// HandleTus serves the tus endpoints mounted at TusBasePath.
+func HandleTus(w http.ResponseWriter, r *http.Request) {
+	// Some clients cannot send PATCH or DELETE and tunnel them through POST
+	method := r.Method
+	if override := r.Header.Get("X-HTTP-Method-Override"); override != "" {
+		method = strings.ToUpper(override)
+	}
+
+	if method == http.MethodOptions {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", tusExtension)
+		if MaxFileSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(MaxFileSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		writeError(w, http.StatusPreconditionFailed, CodeTusVersion, "Unsupported tus version")
+		return
+	}
+
+	uploadID := strings.Trim(strings.TrimPrefix(r.URL.Path, TusBasePath), "/")
+	if uploadID == "" {
+		if method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		handleTusCreate(w, r)
+		return
+	}
+
+	uploadsMutex.RLock()
+	upload, exists := activeUploads[uploadID]
+	uploadsMutex.RUnlock()
+
+	if !exists || !upload.Tus {
+		writeError(w, http.StatusNotFound, CodeUploadNotFound, "Upload not found")
+		return
+	}
+
+	upload.mutex.RLock()
+	expired := upload.expired()
+	cancelled := upload.State == StateCancelled
+	upload.mutex.RUnlock()
+	if expired {
+		discardUpload(upload)
+		writeError(w, http.StatusGone, CodeUploadExpired, "Upload expired")
+		return
+	}
+	if cancelled {
+		writeError(w, http.StatusGone, CodeUploadCancelled, "Upload cancelled")
+		return
+	}
+
+	switch method {
+	case http.MethodHead:
+		handleTusHead(w, upload)
+	case http.MethodPatch:
+		handleTusPatch(w, r, upload)
+	case http.MethodDelete:
+		cancelUpload(upload)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, "HEAD, PATCH, DELETE")
+	}
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid Upload-Length header")
+		return
+	}
+
+	var limitErr *LimitError
+	if err := checkFileSize(length); errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	rawMetadata := r.Header.Get("Upload-Metadata")
+	metadata, err := parseTusMetadata(rawMetadata)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid Upload-Metadata header: "+err.Error())
+		return
+	}
+
+	uploadID := fmt.Sprintf("%d", time.Now().UnixNano())
+	filename := metadata["filename"]
+	if filename == "" {
+		filename = uploadID
+	}
+	if filename, err = sanitizeFilename(filename); err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, err.Error())
+		return
+	}
+
+	// Same rule as HandleInitiateUpload: never overwrite unless asked to
+	if _, err := FinalStorage.Stat(filename); err == nil && metadata["replace"] != "true" && !UseStorageKeys {
+		writeError(w, http.StatusConflict, CodeFileExists, "File already exists")
+		return
+	}
+
+	storedName, err := storageName(filename)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error assigning storage key: "+err.Error())
+		return
+	}
+
+	upload := &ChunkedUpload{
+		ID:             uploadID,
+		Filename:       filename,
+		ReceivedChunks: make(map[int]bool),
+		TotalSize:      length,
+		Tus:            true,
+		TusMetadata:    rawMetadata,
+		State:          StateReceiving,
+		ClientID:       clientID(r),
+		ContentType:    metadata["filetype"],
+	}
+	if storedName != filename {
+		upload.StorageKey = storedName
+	}
+	upload.touch()
+
+	if err := registerUpload(upload); errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	if err := os.MkdirAll(tempDir(uploadID), 0755); err != nil {
+		discardUpload(upload)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error creating upload directory: "+err.Error())
+		return
+	}
+	// tus data is appended, so the file starts out empty
+	if err := createDataFile(uploadID, 0); err != nil {
+		discardUpload(upload)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error creating upload file: "+err.Error())
+		return
+	}
+
+	if err := saveManifest(upload); err != nil {
+		discardUpload(upload)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving upload session: "+err.Error())
+		return
+	}
+
+	// An empty file is complete as soon as it is created
+	if length == 0 {
+		upload.setState(StateMerging, nil)
+		if err := runTusFinish(upload); err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error finishing upload: "+err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Location", TusBasePath+uploadID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, upload *ChunkedUpload) {
+	upload.mutex.RLock()
+	defer upload.mutex.RUnlock()
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.UploadedSize, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.TotalSize, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	if upload.TusMetadata != "" {
+		w.Header().Set("Upload-Metadata", upload.TusMetadata)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request, upload *ChunkedUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Invalid Upload-Offset header")
+		return
+	}
+
+	// Reserve the upload so two PATCH requests never write at once
+	upload.mutex.Lock()
+	if upload.State != StateReceiving {
+		upload.mutex.Unlock()
+		writeError(w, http.StatusForbidden, CodeUploadNotReceiving, fmt.Sprintf("Upload is %s and no longer accepts data", upload.State))
+		return
+	}
+	if upload.patching {
+		upload.mutex.Unlock()
+		writeError(w, http.StatusConflict, CodeUploadLocked, "Another PATCH is in progress for this upload")
+		return
+	}
+	if offset != upload.UploadedSize {
+		current := upload.UploadedSize
+		upload.mutex.Unlock()
+		writeError(w, http.StatusConflict, CodeOffsetMismatch, fmt.Sprintf("Upload-Offset %d does not match current offset %d", offset, current))
+		return
+	}
+	upload.patching = true
+	remaining := upload.TotalSize - offset
+	upload.mutex.Unlock()
+
+	// PATCH requests count against the global write limit like chunks do
+	release, reason := upload.acquireChunkWrite()
+	if release == nil {
+		upload.mutex.Lock()
+		upload.patching = false
+		upload.mutex.Unlock()
+		throttle(w, reason)
+		return
+	}
+	defer release()
+
+	// The first bytes of the file carry its magic number
+	var body io.Reader = r.Body
+	if offset == 0 {
+		sniffed, rest, err := sniff(io.LimitReader(r.Body, remaining))
+		if err == nil {
+			err = Policies["tus"].Check(upload.Filename, upload.ContentType, sniffed)
+		}
+		if err != nil {
+			upload.mutex.Lock()
+			upload.patching = false
+			upload.mutex.Unlock()
+
+			var policyErr *PolicyError
+			if errors.As(err, &policyErr) {
+				rejectUpload(upload, policyErr)
+				writeError(w, http.StatusUnsupportedMediaType, CodeContentRejected, policyErr.Error())
+				return
+			}
+			writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Error reading upload data: "+err.Error())
+			return
+		}
+		body = rest
+	}
+
+	written, writeErr := appendTusData(upload, offset, io.LimitReader(body, remaining))
+
+	// Keep whatever arrived, even if the connection dropped part way, so the
+	// client can resume from the new offset
+	upload.mutex.Lock()
+	upload.patching = false
+	upload.UploadedSize += written
+	upload.touch()
+	newOffset := upload.UploadedSize
+	isComplete := upload.hasAllData()
+	if isComplete {
+		upload.State = StateMerging
+	}
+	saveManifest(upload)
+	publishProgress(upload.ID, "bytes", map[string]interface{}{
+		"uploadedSize": newOffset,
+		"totalSize":    upload.TotalSize,
+	})
+	if isComplete {
+		upload.publishState()
+	}
+	upload.mutex.Unlock()
+
+	if upload.cancelled() {
+		writeError(w, http.StatusGone, CodeUploadCancelled, "Upload cancelled")
+		return
+	}
+
+	if writeErr != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error writing upload data: "+writeErr.Error())
+		return
+	}
+
+	if isComplete {
+		if err := runTusFinish(upload); errors.Is(err, ErrUploadCancelled) {
+			writeError(w, http.StatusGone, CodeUploadCancelled, "Upload cancelled")
+			return
+		} else if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Error finishing upload: "+err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runTusFinish moves a fully received tus upload into FinalStorage and
+// records the outcome on the session.
+func runTusFinish(upload *ChunkedUpload) error {
+	ctx, ok := upload.beginFinish()
+	if !ok {
+		return ErrUploadCancelled
+	}
+
+	err := finishUpload(ctx, upload, dataPath(upload.ID))
+	if err != nil && !errors.Is(err, ErrUploadCancelled) {
+		fmt.Printf("Finishing tus upload %s failed: %v\n", upload.ID, err)
+	}
+	upload.endFinish(err)
+	return err
+}
+
+// appendTusData writes body into the upload's data file starting at offset
+// and returns the number of bytes that reached the file.
+func appendTusData(upload *ChunkedUpload, offset int64, body io.Reader) (int64, error) {
+	dataFile, err := os.OpenFile(dataPath(upload.ID), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer dataFile.Close()
+
+	// Drop any bytes past the acknowledged offset left by an earlier failure
+	if err := dataFile.Truncate(offset); err != nil {
+		return 0, err
+	}
+	if _, err := dataFile.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	return io.Copy(dataFile, body)
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated
+// "key base64value" pairs, where the value may be omitted.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		switch len(parts) {
+		case 1:
+			metadata[parts[0]] = ""
+		case 2:
+			value, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("value for %q is not base64", parts[0])
+			}
+			metadata[parts[0]] = string(value)
+		default:
+			return nil, fmt.Errorf("malformed pair %q", pair)
+		}
+	}
+
+	return metadata, nil
+}
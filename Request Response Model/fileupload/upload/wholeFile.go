@@ -1,48 +1,121 @@
 package upload
 
 import (
+	"encoding/hex"
+	"errors"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 )
 
 func HandleSingleUpload(w http.ResponseWriter, r *http.Request) {
 	// Check if the request method is POST
 	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		methodNotAllowed(w, http.MethodPost)
 		return
 	}
 
+	// Refuse bodies that cannot fit within MaxFileSize
+	if MaxFileSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, MaxFileSize+multipartOverhead)
+	}
+
 	// Parse the multipart form
 	err := r.ParseMultipartForm(32 << 20) // 32MB max memory
 	if err != nil {
-		http.Error(w, "Error parsing form: "+err.Error(), http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			limitErr := tooLarge(CodeFileTooLarge, "maxFileSize", "request body exceeds the limit of %d bytes", MaxFileSize)
+			writeLimitError(w, limitErr)
+			return
+		}
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Error parsing form: "+err.Error())
 		return
 	}
 
 	// Get the file from the form
 	file, header, err := r.FormFile("file")
 	if err != nil {
-		http.Error(w, "Error getting file: "+err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Error getting file: "+err.Error())
 		return
 	}
 	defer file.Close()
 
-	// Create the destination file
-	dst, err := os.Create(filepath.Join("uploads/final", header.Filename))
+	var limitErr *LimitError
+	if err := checkFileSize(header.Size); errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	filename, err := sanitizeFilename(header.Filename)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeInvalidFilename, err.Error())
+		return
+	}
+
+	metadata, tags, err := parseFormMetadata(r.MultipartForm.Value)
+	if errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	storedName, err := storageName(filename)
 	if err != nil {
-		http.Error(w, "Error creating file: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error assigning storage key: "+err.Error())
 		return
 	}
-	defer dst.Close()
 
-	// Copy the file
-	_, err = io.Copy(dst, file)
+	sniffed, body, err := sniff(file)
 	if err != nil {
-		http.Error(w, "Error saving file: "+err.Error(), http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, CodeInvalidRequest, "Error reading file: "+err.Error())
+		return
+	}
+	if err := Policies["single"].Check(filename, header.Header.Get("Content-Type"), sniffed); err != nil {
+		writeError(w, http.StatusUnsupportedMediaType, CodeContentRejected, err.Error())
 		return
 	}
 
-	w.Write([]byte("File uploaded successfully"))
+	// The file counts against the client's quota from here on
+	quota := &quotaReservation{client: clientID(r)}
+	defer quota.release()
+	if err := quota.reserve(header.Size); errors.As(err, &limitErr) {
+		writeLimitError(w, limitErr)
+		return
+	}
+
+	// Stream the file into final storage, hashing it on the way
+	hasher := newHash()
+	if err := FinalStorage.Put(storedName, io.TeeReader(body, hasher), header.Size); err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving file: "+err.Error())
+		return
+	}
+
+	// Keep the original name next to a server assigned key, along with the
+	// client's metadata
+	record := fileRecord{Checksum: hex.EncodeToString(hasher.Sum(nil)), ClientID: quota.client, Metadata: metadata, Tags: tags}
+	if storedName != filename {
+		record.OriginalName = filename
+		w.Header().Set("X-Storage-Key", storedName)
+	}
+	if err := storeFileRecord(storedName, record); err != nil {
+		FinalStorage.Delete(storedName)
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Error saving file record: "+err.Error())
+		return
+	}
+	recordStoredFile(storedName, quota.client, header.Size)
+
+	response := map[string]interface{}{
+		"filename": filename,
+		"size":     header.Size,
+		"message":  "File uploaded successfully",
+	}
+	if storedName != filename {
+		response["storageKey"] = storedName
+	}
+	if metadata != nil {
+		response["metadata"] = metadata
+	}
+	if tags != nil {
+		response["tags"] = tags
+	}
+	writeJSON(w, http.StatusOK, response)
 }